@@ -15,6 +15,9 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/ArthurHlt/go-kairosdb/builder"
 	kclient "github.com/ArthurHlt/go-kairosdb/client"
@@ -24,76 +27,130 @@ import (
 	log "github.com/sirupsen/logrus"
 	"math"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
 
 type Adapter interface {
-	Write(s *model.Sample) error
-	Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error)
+	// Write gives the number of samples sent to the tsdb, samples with a value the tsdb can't store are dropped
+	Write(samples model.Samples) (int, error)
+	// Read stops querying the tsdb when ctx is done
+	Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error)
 	Healthy() bool
 	Name() string
 }
 
+// SeriesStreamer is implemented by adapters which can send the series of a query one by one
+// while the tsdb response is read instead of building the whole response
+type SeriesStreamer interface {
+	// ReadSeries stops when send fails and returns its error
+	ReadSeries(ctx context.Context, q *prompb.Query, send func(*prompb.TimeSeries) error) error
+}
+
+func init() {
+	RegisterBackend("kairosdb", func() interface{} { return &KairosConfig{} }, newKairosBackend)
+}
+
+type KairosConfig struct {
+	Url          string                 `yaml:"url"`
+	SkipInsecure bool                   `yaml:"skip_insecure"`
+	ReadHints    bool                   `yaml:"read_hints"`
+	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *KairosConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain KairosConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("Config backend kairosdb: url must be set")
+	}
+	return checkBackendOverflow(c.XXX, "Config backend kairosdb")
+}
+
+func newKairosBackend(config interface{}, opts BackendOptions) (Adapter, error) {
+	c := config.(*KairosConfig)
+	client := createClient(opts.Name, c.SkipInsecure, opts.Workers)
+	adapter := NewKairosAdapter(c.Url, client, opts.BatchSize)
+	adapter.readHints = c.ReadHints
+	return adapter, nil
+}
+
+const (
+	kairosQueryPath     = "/api/v1/datapoints/query"
+	kairosQueryTagsPath = "/api/v1/datapoints/query/tags"
+)
+
 type KairosAdapter struct {
-	client kclient.Client
+	url        string
+	httpClient *http.Client
+	client     kclient.Client
+	batchSize  int
+	readHints  bool
 }
 
-func NewKairosAdapter(kairosUrl string, client *http.Client) *KairosAdapter {
-	return &KairosAdapter{kclient.NewHttpClient(kairosUrl, kclient.NetHttpClient(client))}
+func NewKairosAdapter(kairosUrl string, client *http.Client, batchSize int) *KairosAdapter {
+	return &KairosAdapter{
+		url:        strings.TrimSuffix(kairosUrl, "/"),
+		httpClient: client,
+		client:     kclient.NewHttpClient(kairosUrl, kclient.NetHttpClient(client)),
+		batchSize:  batchSize,
+	}
 }
-func (a KairosAdapter) mergeResult(labelsToSeries map[string]*prompb.TimeSeries, results []response.Queries) error {
+func (a KairosAdapter) mergeResult(labelsToSeries map[string]*prompb.TimeSeries, results []response.Queries, matchers []labelMatcher, sampling *kairosSampling) error {
 	for _, r := range results {
 		for _, s := range r.ResultsArr {
-			k := a.concatLabels(s.Tags)
-			ts, ok := labelsToSeries[k]
-			if !ok {
-				ts = &prompb.TimeSeries{
-					Labels: a.tagsToLabelPairs(s.Name, s.Tags),
-				}
-				labelsToSeries[k] = ts
-			}
-
-			samples, err := a.valuesToSamples(s.DataPoints)
+			result, ok, err := a.resultToSeries(s, matchers, sampling)
 			if err != nil {
 				return err
 			}
-
-			ts.Samples = a.mergeSamples(ts.Samples, samples)
+			if !ok {
+				continue
+			}
+			k := labelsKey(result.Labels)
+			ts, ok := labelsToSeries[k]
+			if !ok {
+				labelsToSeries[k] = result
+				continue
+			}
+			ts.Samples = mergeSamples(ts.Samples, result.Samples)
 		}
 	}
 	return nil
 }
 
-func (KairosAdapter) mergeSamples(a, b []*prompb.Sample) []*prompb.Sample {
-	result := make([]*prompb.Sample, 0, len(a)+len(b))
-	i, j := 0, 0
-	for i < len(a) && j < len(b) {
-		if a[i].Timestamp < b[j].Timestamp {
-			result = append(result, a[i])
-			i++
-		} else if a[i].Timestamp > b[j].Timestamp {
-			result = append(result, b[j])
-			j++
-		} else {
-			result = append(result, a[i])
-			i++
-			j++
-		}
-	}
-	result = append(result, a[i:]...)
-	result = append(result, b[j:]...)
-	return result
+// resultToSeries converts a kairosdb result, false is returned when the series is not matched by the query
+func (a KairosAdapter) resultToSeries(s response.Results, matchers []labelMatcher, sampling *kairosSampling) (*prompb.TimeSeries, bool, error) {
+	labels := a.tagsToLabelPairs(s.Name, s.Tags)
+	// kairos query selects a superset of the series matched by the query
+	if !matchLabels(matchers, labels) {
+		return nil, false, nil
+	}
+	samples, err := a.valuesToSamples(s.DataPoints)
+	if err != nil {
+		return nil, false, err
+	}
+	if sampling != nil {
+		for i := range samples {
+			samples[i].Timestamp = sampling.timestamp(samples[i].Timestamp)
+		}
+	}
+	return &prompb.TimeSeries{
+		Labels:  labels,
+		Samples: samples,
+	}, true, nil
 }
 
-func (KairosAdapter) valuesToSamples(datapoints []builder.DataPoint) ([]*prompb.Sample, error) {
-	samples := make([]*prompb.Sample, 0, len(datapoints))
+func (KairosAdapter) valuesToSamples(datapoints []builder.DataPoint) ([]prompb.Sample, error) {
+	samples := make([]prompb.Sample, 0, len(datapoints))
 	for _, datapoint := range datapoints {
 		v, err := datapoint.Float64Value()
 		if err != nil {
 			return nil, err
 		}
-		samples = append(samples, &prompb.Sample{
+		samples = append(samples, prompb.Sample{
 			Timestamp: datapoint.Timestamp(),
 			Value:     v,
 		})
@@ -101,8 +158,8 @@ func (KairosAdapter) valuesToSamples(datapoints []builder.DataPoint) ([]*prompb.
 	return samples, nil
 }
 
-func (KairosAdapter) tagsToLabelPairs(name string, tags map[string][]string) []*prompb.Label {
-	pairs := make([]*prompb.Label, 0, len(tags))
+func (KairosAdapter) tagsToLabelPairs(name string, tags map[string][]string) []prompb.Label {
+	pairs := make([]prompb.Label, 0, len(tags))
 	for k, values := range tags {
 		if len(values) == 0 {
 			// I don't know what i'm doing here
@@ -115,47 +172,36 @@ func (KairosAdapter) tagsToLabelPairs(name string, tags map[string][]string) []*
 			continue
 		}
 		for _, v := range values {
-			pairs = append(pairs, &prompb.Label{
+			pairs = append(pairs, prompb.Label{
 				Name:  k,
 				Value: v,
 			})
 		}
 	}
-	pairs = append(pairs, &prompb.Label{
+	pairs = append(pairs, prompb.Label{
 		Name:  model.MetricNameLabel,
 		Value: name,
 	})
 	return pairs
 }
 
-func (KairosAdapter) concatLabels(labels map[string][]string) string {
-	// 0xff cannot cannot occur in valid UTF-8 sequences, so use it
-	// as a separator here.
-	separator := "\xff"
-	pairs := make([]string, 0, len(labels))
-	for k, v := range labels {
-		pairs = append(pairs, k+separator+strings.Join(v, separator))
-	}
-	return strings.Join(pairs, separator)
-}
-
-func (a KairosAdapter) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+func (a KairosAdapter) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	labelsToSeries := map[string]*prompb.TimeSeries{}
 	for _, q := range req.Queries {
-		qbuilder, err := a.buildQuery(q)
+		qBuilder, groupTags, matchers, sampling, err := a.prepareQuery(ctx, q)
 		if err != nil {
 			return nil, err
 		}
+		if len(qBuilder.Metrics()) == 0 {
+			continue
+		}
 
-		resp, err := a.client.Query(qbuilder)
+		resp, err := a.query(ctx, kairosQueryPath, qBuilder, groupTags)
 		if err != nil {
 			return nil, err
 		}
-		if resp.Errors != nil && len(resp.Errors) > 0 {
-			return nil, fmt.Errorf(strings.Join(resp.Errors, "\n"))
-		}
 
-		if err = a.mergeResult(labelsToSeries, resp.QueriesArr); err != nil {
+		if err = a.mergeResult(labelsToSeries, resp.QueriesArr, matchers, sampling); err != nil {
 			return nil, err
 		}
 	}
@@ -171,102 +217,340 @@ func (a KairosAdapter) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, erro
 	return &resp, nil
 }
 
-func (a KairosAdapter) Write(s *model.Sample) error {
-	v := float64(s.Value)
-	if math.IsNaN(v) || math.IsInf(v, 0) {
-		log.Debug("Skipping sample, kairosdb doesn't support NaN or infinite value.")
+// ReadSeries sends series of the query one by one while the kairosdb response is decoded,
+// series are grouped by every tag of their metric so each result of kairosdb is a distinct series
+func (a KairosAdapter) ReadSeries(ctx context.Context, q *prompb.Query, send func(*prompb.TimeSeries) error) error {
+	qBuilder, groupTags, matchers, sampling, err := a.prepareQuery(ctx, q)
+	if err != nil {
+		return err
+	}
+	if len(qBuilder.Metrics()) == 0 {
 		return nil
 	}
+	return a.queryResults(ctx, kairosQueryPath, qBuilder, groupTags, func(s response.Results) error {
+		ts, ok, err := a.resultToSeries(s, matchers, sampling)
+		if err != nil || !ok {
+			return err
+		}
+		return send(ts)
+	})
+}
+
+// prepareQuery builds the kairosdb query of a prometheus query with the aggregator of read hints when enabled
+func (a KairosAdapter) prepareQuery(ctx context.Context, q *prompb.Query) (builder.QueryBuilder, [][]string, []labelMatcher, *kairosSampling, error) {
+	matchers, err := newLabelMatchers(q.Matchers)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	qBuilder, groupTags, err := a.buildQuery(ctx, q, matchers)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var sampling *kairosSampling
+	if a.readHints {
+		sampling = newKairosSampling(q.Hints)
+	}
+	if sampling != nil {
+		for _, m := range qBuilder.Metrics() {
+			m.AddAggregator(sampling.Aggregator())
+		}
+	}
+	return qBuilder, groupTags, matchers, sampling, nil
+}
+
+func (a KairosAdapter) Write(samples model.Samples) (int, error) {
+	// data points are grouped by series and sent in batches of at most batchSize points
 	mb := builder.NewMetricBuilder()
-	metricName := "none"
-	tags := make(map[string]string)
-	for name, value := range s.Metric {
-		sVal := string(value)
-		sName := string(name)
-		if sName == model.MetricNameLabel {
-			metricName = sVal
-		} else {
-			tags[sName] = sVal
-		}
-	}
-	metric := mb.AddMetric(metricName).AddTags(tags)
-	metric.AddType("double")
-	metric.AddDataPoint(makeTimestamp(s.Timestamp), v)
-
-	_, err := a.client.PushMetrics(mb)
+	metrics := make(map[model.Fingerprint]builder.Metric)
+	nbPoints := 0
+	written := 0
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Debug("Skipping sample, kairosdb doesn't support NaN or infinite value.")
+			samplesDropped.WithLabelValues("invalid_value").Inc()
+			continue
+		}
+		fp := s.Metric.Fingerprint()
+		metric, ok := metrics[fp]
+		if !ok {
+			metricName, tags := metricToTags(s.Metric)
+			metric = mb.AddMetric(metricName).AddTags(tags)
+			metric.AddType("double")
+			metrics[fp] = metric
+		}
+		metric.AddDataPoint(makeTimestamp(s.Timestamp), v)
+		nbPoints++
+
+		if nbPoints < a.batchSize {
+			continue
+		}
+		err := a.pushMetrics(mb)
+		if err != nil {
+			return written, err
+		}
+		written += nbPoints
+		mb = builder.NewMetricBuilder()
+		metrics = make(map[model.Fingerprint]builder.Metric)
+		nbPoints = 0
+	}
+	if nbPoints == 0 {
+		return written, nil
+	}
+	if err := a.pushMetrics(mb); err != nil {
+		return written, err
+	}
+	return written + nbPoints, nil
+}
+
+func (a KairosAdapter) pushMetrics(mb builder.MetricBuilder) error {
+	resp, err := a.client.PushMetrics(mb)
+	if err != nil {
+		return kairosError(err)
+	}
+	if resp.GetStatusCode() == http.StatusNoContent {
+		return nil
+	}
+	err = fmt.Errorf(
+		"kairosdb rejected data points with status code %d: %s",
+		resp.GetStatusCode(),
+		strings.Join(resp.GetErrors(), ", "),
+	)
+	if resp.GetStatusCode() >= http.StatusInternalServerError ||
+		resp.GetStatusCode() == http.StatusTooManyRequests {
+		return NewRecoverableError(err)
+	}
 	return err
 }
 
-func (a KairosAdapter) buildQuery(q *prompb.Query) (builder.QueryBuilder, error) {
-	// Note: GetMetricNamesNeq, GetMetricNamesReg, GetTagValuesNeq, GetTagValuesReg are cached for 30 seconds by clients to make things faster
+// buildQuery makes a kairos query selecting, for each metric matching name matchers, the series
+// which may match tag matchers. Tag values are resolved from the tags of each metric in the time range
+// of the query. A matcher which matches an empty value also selects series without the tag and can't be
+// expressed in kairos, it is applied on results as every other matcher.
+// Series are grouped by the tags of their metric, group tags are given in the order of the metrics of the query.
+func (a KairosAdapter) buildQuery(ctx context.Context, q *prompb.Query, matchers []labelMatcher) (builder.QueryBuilder, [][]string, error) {
+	qBuilder := a.newQueryBuilder(q)
+	metricNames, err := a.metricNames(matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(metricNames) == 0 {
+		return qBuilder, nil, nil
+	}
+
+	tagMatchers := make(map[string][]labelMatcher)
+	equalTags := make(map[string][]string)
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel {
+			continue
+		}
+		tagMatchers[m.Name] = append(tagMatchers[m.Name], m)
+		if m.Type == prompb.LabelMatcher_EQ && m.Value != "" {
+			equalTags[m.Name] = []string{m.Value}
+		}
+	}
+
+	tagsQuery := a.newQueryBuilder(q)
+	for _, name := range metricNames {
+		tagsQuery.AddMetric(name).AddTags(equalTags)
+	}
+	tagsResp, err := a.query(ctx, kairosQueryTagsPath, tagsQuery, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groupTags := make([][]string, 0, len(metricNames))
+	for _, r := range tagsResp.QueriesArr {
+		for _, s := range r.ResultsArr {
+			tags, ok := a.resolveTags(s.Tags, tagMatchers)
+			if !ok {
+				continue
+			}
+			qBuilder.AddMetric(s.Name).AddTags(tags)
+			names := make([]string, 0, len(s.Tags))
+			for name := range s.Tags {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			groupTags = append(groupTags, names)
+		}
+	}
+	return qBuilder, groupTags, nil
+}
 
-	a.client.GetMetricNames()
+func (KairosAdapter) newQueryBuilder(q *prompb.Query) builder.QueryBuilder {
 	qBuilder := builder.NewQueryBuilder()
 	qBuilder.SetAbsoluteStart(msToTime(q.StartTimestampMs))
 	qBuilder.SetAbsoluteEnd(msToTime(q.EndTimestampMs))
+	return qBuilder
+}
 
-	metricNames := make([]string, 0)
-	tags := make(map[string][]string)
-	for _, m := range q.Matchers {
-		if m.Name == model.MetricNameLabel {
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				metricNames = append(metricNames, m.Value)
-			case prompb.LabelMatcher_NEQ:
-				reNames, err := a.client.GetMetricNamesNeq(m.Value)
-				if err != nil {
-					return nil, err
-				}
-				metricNames = append(metricNames, reNames...)
-			case prompb.LabelMatcher_RE:
-				reNames, err := a.client.GetMetricNamesReg(m.Value, false)
-				if err != nil {
-					return nil, err
-				}
-				metricNames = append(metricNames, reNames...)
-			case prompb.LabelMatcher_NRE:
-				reNames, err := a.client.GetMetricNamesReg(m.Value, true)
-				if err != nil {
-					return nil, err
-				}
-				metricNames = append(metricNames, reNames...)
-			default:
-				return nil, fmt.Errorf("unknown match type %v", m.Type)
-			}
+// metricNames gives metric names matching all name matchers,
+// metric names list is cached for 30 seconds by kairos client which can't be cancelled
+func (a KairosAdapter) metricNames(matchers []labelMatcher) ([]string, error) {
+	var candidates []string
+	nameMatchers := make([]labelMatcher, 0)
+	for _, m := range matchers {
+		if m.Name != model.MetricNameLabel {
 			continue
 		}
-		if _, ok := tags[m.Name]; !ok {
-			tags[m.Name] = make([]string, 0)
+		nameMatchers = append(nameMatchers, m)
+		if m.Type == prompb.LabelMatcher_EQ && candidates == nil {
+			candidates = []string{m.Value}
 		}
-		switch m.Type {
-		case prompb.LabelMatcher_EQ:
-			tags[m.Name] = append(tags[m.Name], m.Value)
-		case prompb.LabelMatcher_NEQ:
-			neqValues, err := a.client.GetTagValuesNeq(m.Value)
-			if err != nil {
-				return nil, err
+	}
+	if candidates == nil {
+		resp, err := a.client.GetMetricNames()
+		if err != nil {
+			return nil, kairosError(err)
+		}
+		if resp.GetStatusCode() != http.StatusOK {
+			err = fmt.Errorf("kairosdb responded with status code %d when listing metric names", resp.GetStatusCode())
+			if resp.GetStatusCode() >= http.StatusInternalServerError {
+				return nil, NewRecoverableError(err)
 			}
-			tags[m.Name] = append(tags[m.Name], neqValues...)
-		case prompb.LabelMatcher_RE:
-			reValues, err := a.client.GetTagValuesReg(m.Value, false)
-			if err != nil {
-				return nil, err
+			return nil, err
+		}
+		candidates = resp.Results
+	}
+
+	names := make([]string, 0, len(candidates))
+	for _, name := range candidates {
+		matched := name != ""
+		for _, m := range nameMatchers {
+			matched = matched && m.matches(name)
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// resolveTags gives kairos tag filters for a metric with the given tags,
+// it returns false if no series of the metric can match
+func (KairosAdapter) resolveTags(metricTags map[string][]string, tagMatchers map[string][]labelMatcher) (map[string][]string, bool) {
+	tags := make(map[string][]string)
+	for name, matchers := range tagMatchers {
+		matchEmpty := true
+		for _, m := range matchers {
+			matchEmpty = matchEmpty && m.matches("")
+		}
+		if matchEmpty {
+			continue
+		}
+		values := make([]string, 0)
+		for _, v := range metricTags[name] {
+			matched := true
+			for _, m := range matchers {
+				matched = matched && m.matches(v)
 			}
-			tags[m.Name] = append(tags[m.Name], reValues...)
-		case prompb.LabelMatcher_NRE:
-			reValues, err := a.client.GetTagValuesReg(m.Value, true)
-			if err != nil {
-				return nil, err
+			if matched {
+				values = append(values, v)
 			}
-			tags[m.Name] = append(tags[m.Name], reValues...)
-		default:
-			return nil, fmt.Errorf("unknown match type %v", m.Type)
 		}
+		if len(values) == 0 {
+			return nil, false
+		}
+		tags[name] = values
 	}
-	for _, name := range metricNames {
-		qBuilder.AddMetric(name).AddTags(tags)
+	return tags, true
+}
+
+// query sends a query to kairos, the builder has no group by support
+// so group by tags is added to the metrics of the built query when groupTags is set
+func (a KairosAdapter) query(ctx context.Context, path string, qBuilder builder.QueryBuilder, groupTags [][]string) (*response.QueryResponse, error) {
+	httpResp, err := a.post(ctx, path, qBuilder, groupTags)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	resp := response.NewQueryResponse(httpResp.StatusCode)
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	if err = kairosResponseError(httpResp.StatusCode, resp.Errors); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// queryResults sends results of the query one by one while the response is decoded,
+// a result is decoded only when the previous one has been sent
+func (a KairosAdapter) queryResults(ctx context.Context, path string, qBuilder builder.QueryBuilder, groupTags [][]string, send func(response.Results) error) error {
+	httpResp, err := a.post(ctx, path, qBuilder, groupTags)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		resp := response.NewQueryResponse(httpResp.StatusCode)
+		if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+			return kairosResponseError(httpResp.StatusCode, []string{err.Error()})
+		}
+		return kairosResponseError(httpResp.StatusCode, resp.Errors)
+	}
+
+	// the response is {"queries": [{"sample_size": n, "results": [...]}, ...]}
+	var sendErr error
+	decoder := json.NewDecoder(httpResp.Body)
+	err = decodeJSONObject(decoder, "queries", func() error {
+		return decodeJSONArray(decoder, func() error {
+			return decodeJSONObject(decoder, "results", func() error {
+				return decodeJSONArray(decoder, func() error {
+					var result response.Results
+					if err := decoder.Decode(&result); err != nil {
+						return err
+					}
+					sendErr = send(result)
+					return sendErr
+				})
+			})
+		})
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return NewRecoverableError(err)
+	}
+	return nil
+}
+
+func (a KairosAdapter) post(ctx context.Context, path string, qBuilder builder.QueryBuilder, groupTags [][]string) (*http.Response, error) {
+	data, err := qBuilder.Build()
+	if err != nil {
+		return nil, kairosError(err)
+	}
+	if groupTags != nil {
+		data, err = kairosGroupByTags(data, groupTags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, a.url+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := a.httpClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, NewRecoverableError(err)
 	}
-	return qBuilder, nil
+	return httpResp, nil
+}
+
+func kairosResponseError(statusCode int, errs []string) error {
+	if len(errs) == 0 && statusCode == http.StatusOK {
+		return nil
+	}
+	err := fmt.Errorf("kairosdb responded with status code %d: %s", statusCode, strings.Join(errs, "\n"))
+	if statusCode >= http.StatusInternalServerError {
+		return NewRecoverableError(err)
+	}
+	return err
 }
 
 func (a KairosAdapter) Healthy() bool {
@@ -281,6 +565,43 @@ func (a KairosAdapter) Name() string {
 	return "kairosdb"
 }
 
+// kairosError marks errors from kairos client as recoverable
+// except the ones coming from invalid metrics or queries
+func kairosError(err error) error {
+	switch err {
+	case builder.ErrorMetricNameInvalid, builder.ErrorTagNameInvalid,
+		builder.ErrorTagValueInvalid, builder.ErrorTTLInvalid,
+		builder.ErrorQMetricNameInvalid, builder.ErrorQMetricTagNameInvalid,
+		builder.ErrorQMetricTagValueInvalid, builder.ErrorQMetricLimitInvalid,
+		builder.ErrorStartTimeNotSpecified:
+		return err
+	}
+	return NewRecoverableError(err)
+}
+
+func kairosGroupByTags(data []byte, groupTags [][]string) ([]byte, error) {
+	var query map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&query)
+	if err != nil {
+		return nil, err
+	}
+	metrics, _ := query["metrics"].([]interface{})
+	if len(metrics) != len(groupTags) {
+		return nil, fmt.Errorf("cannot group by tags %d metrics with %d tags list", len(metrics), len(groupTags))
+	}
+	for i, metric := range metrics {
+		if len(groupTags[i]) == 0 {
+			continue
+		}
+		metric.(map[string]interface{})["group_by"] = []map[string]interface{}{
+			{"name": "tag", "tags": groupTags[i]},
+		}
+	}
+	return json.Marshal(query)
+}
+
 func makeTimestamp(timestamp model.Time) int64 {
 	return timestamp.UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 }
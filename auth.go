@@ -0,0 +1,382 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	permissionRead  = "read"
+	permissionWrite = "write"
+	authRealm       = "prometheus-fast-remote"
+)
+
+type AuthConfig struct {
+	Tokens       []*TokenConfig         `yaml:"tokens"`
+	HtpasswdFile string                 `yaml:"htpasswd_file"`
+	Users        []*IdentityConfig      `yaml:"users"`
+	ClientCAFile string                 `yaml:"client_ca_file"`
+	ClientCerts  []*IdentityConfig      `yaml:"client_certs"`
+	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// TokenConfig is a static bearer token, name is only used in logs and as default tenant
+type TokenConfig struct {
+	Name        string                 `yaml:"name"`
+	Token       string                 `yaml:"token"`
+	Permissions []string               `yaml:"permissions"`
+	Tenants     []string               `yaml:"tenants"`
+	XXX         map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// IdentityConfig gives permissions to a user of htpasswd file or to a client certificate common name
+type IdentityConfig struct {
+	Name        string                 `yaml:"name"`
+	Permissions []string               `yaml:"permissions"`
+	Tenants     []string               `yaml:"tenants"`
+	XXX         map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *AuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Tokens) == 0 && c.HtpasswdFile == "" && c.ClientCAFile == "" {
+		return fmt.Errorf("Config auth: tokens, htpasswd_file or client_ca_file must be set")
+	}
+	if len(c.Users) > 0 && c.HtpasswdFile == "" {
+		return fmt.Errorf("Config auth: htpasswd_file must be set to give permissions to users")
+	}
+	if len(c.ClientCerts) > 0 && c.ClientCAFile == "" {
+		return fmt.Errorf("Config auth: client_ca_file must be set to give permissions to client certificates")
+	}
+	return checkOverflow(c.XXX, "Config auth")
+}
+
+func (c *TokenConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TokenConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Token == "" {
+		return fmt.Errorf("Config auth tokens: token must be set")
+	}
+	if c.Name == "" {
+		c.Name = "token"
+	}
+	if err := checkPermissions(c.Permissions, "Config auth token "+c.Name); err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "Config auth token "+c.Name)
+}
+
+func (c *IdentityConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain IdentityConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return fmt.Errorf("Config auth: name must be set for users and client certificates")
+	}
+	if err := checkPermissions(c.Permissions, "Config auth "+c.Name); err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "Config auth "+c.Name)
+}
+
+// checkTenants makes sure tenants given to credentials exist, auth can be nil
+func (c *AuthConfig) checkTenants(names map[string]bool) error {
+	if c == nil {
+		return nil
+	}
+	identities := append(append([]*IdentityConfig{}, c.Users...), c.ClientCerts...)
+	for _, t := range c.Tokens {
+		identities = append(identities, &IdentityConfig{Name: t.Name, Tenants: t.Tenants})
+	}
+	for _, identity := range identities {
+		for _, tenant := range identity.Tenants {
+			if !names[tenant] {
+				return fmt.Errorf("Config auth %s: tenant %s does not exist", identity.Name, tenant)
+			}
+		}
+	}
+	return nil
+}
+
+func checkPermissions(permissions []string, ctx string) error {
+	if len(permissions) == 0 {
+		return fmt.Errorf("%s: permissions must be set to %s, %s or both", ctx, permissionRead, permissionWrite)
+	}
+	for _, p := range permissions {
+		if p != permissionRead && p != permissionWrite {
+			return fmt.Errorf("%s: permissions must be %s or %s", ctx, permissionRead, permissionWrite)
+		}
+	}
+	return nil
+}
+
+// allPermissions are given to every user of htpasswd file, or every trusted client certificate,
+// when users, or client_certs, are not listed in config
+var allPermissions = []string{permissionRead, permissionWrite}
+
+// credential is an authenticated caller, it is only allowed what is in its permissions
+// and only reaches its tenants, or the tenant named after it when none are set
+type credential struct {
+	name        string
+	permissions []string
+	tenants     []string
+}
+
+func (c *credential) allowsTenant(tenant string) bool {
+	if len(c.tenants) == 0 {
+		return c.name == tenant
+	}
+	for _, t := range c.tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *credential) allows(permission string) bool {
+	for _, p := range c.permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks bearer tokens, basic auth against bcrypt hashes of an htpasswd file
+// and client certificates signed by a trusted CA
+type Authenticator struct {
+	tokens    map[string]*credential
+	hashes    map[string][]byte
+	users     map[string]*credential
+	clientCAs *x509.CertPool
+	certs     map[string]*credential
+
+	// bcrypt is slow on purpose, passwords already checked are remembered by their hmac
+	// with a key drawn at start so that the cache can't be used to guess them
+	mu        sync.Mutex
+	verified  map[string][]byte
+	verifyKey []byte
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		tokens:   make(map[string]*credential),
+		users:    make(map[string]*credential),
+		certs:    make(map[string]*credential),
+		verified: make(map[string][]byte),
+	}
+	a.verifyKey = make([]byte, sha256.Size)
+	if _, err := rand.Read(a.verifyKey); err != nil {
+		return nil, err
+	}
+	for _, t := range config.Tokens {
+		a.tokens[t.Token] = &credential{name: t.Name, permissions: t.Permissions, tenants: t.Tenants}
+	}
+	if config.HtpasswdFile != "" {
+		hashes, err := loadHtpasswd(config.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Users) == 0 {
+			for name := range hashes {
+				a.users[name] = &credential{name: name, permissions: allPermissions}
+			}
+		}
+		// once users are listed, the ones left out of the list are rejected as unknown
+		for _, u := range config.Users {
+			if _, ok := hashes[u.Name]; !ok {
+				return nil, fmt.Errorf("auth: user %s is not in %s", u.Name, config.HtpasswdFile)
+			}
+			a.users[u.Name] = &credential{name: u.Name, permissions: u.Permissions, tenants: u.Tenants}
+		}
+		a.hashes = make(map[string][]byte)
+		for name := range a.users {
+			a.hashes[name] = hashes[name]
+		}
+	}
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.clientCAs = x509.NewCertPool()
+		if !a.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("auth: no certificate found in %s", config.ClientCAFile)
+		}
+		for _, c := range config.ClientCerts {
+			a.certs[c.Name] = &credential{name: c.Name, permissions: c.Permissions, tenants: c.Tenants}
+		}
+	}
+	return a, nil
+}
+
+// loadHtpasswd reads user:hash lines, only bcrypt hashes are supported
+func loadHtpasswd(filename string) (map[string][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("auth: %s line %d: user:hash expected", filename, lineNumber)
+		}
+		hash := []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("auth: %s line %d: %s, hashes must be made with htpasswd -B", filename, lineNumber, err.Error())
+		}
+		hashes[line[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// require lets the request through if its caller is authenticated and has the permission,
+// a nil authenticator lets every request through
+func (a *Authenticator) require(permission string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		cred := a.authenticate(r)
+		if cred == nil {
+			log.WithField("remote_addr", r.RemoteAddr).Debugf("Unauthenticated request on %s", r.URL.Path)
+			authFailed.WithLabelValues("unauthenticated").Inc()
+			if a.hashes != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authRealm))
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !cred.allows(permission) {
+			log.WithField("remote_addr", r.RemoteAddr).Debugf("%s is not allowed to %s on %s", cred.name, permission, r.URL.Path)
+			authFailed.WithLabelValues("forbidden").Inc()
+			http.Error(w, fmt.Sprintf("%s is not allowed to %s", cred.name, permission), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticate finds the caller from bearer token, basic auth or client certificate in this order
+func (a *Authenticator) authenticate(r *http.Request) *credential {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return a.token(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return a.user(user, password)
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return a.clientCert(r.TLS.PeerCertificates)
+	}
+	return nil
+}
+
+func (a *Authenticator) token(token string) *credential {
+	// every token is compared to not leak which one is closer through timing
+	var found *credential
+	for t, cred := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = cred
+		}
+	}
+	return found
+}
+
+func (a *Authenticator) user(user, password string) *credential {
+	hash, ok := a.hashes[user]
+	if !ok {
+		return nil
+	}
+	mac := hmac.New(sha256.New, a.verifyKey)
+	mac.Write([]byte(password))
+	sum := mac.Sum(nil)
+	a.mu.Lock()
+	verified, ok := a.verified[user]
+	a.mu.Unlock()
+	if ok && hmac.Equal(verified, sum) {
+		return a.users[user]
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil
+	}
+	a.mu.Lock()
+	a.verified[user] = sum
+	a.mu.Unlock()
+	return a.users[user]
+}
+
+// clientCert verifies the certificate chain against client CAs, permissions are found by subject common name,
+// once client_certs are listed, the common names left out of the list are rejected
+func (a *Authenticator) clientCert(certs []*x509.Certificate) *credential {
+	if a.clientCAs == nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		log.Debugf("Client certificate %s is not trusted: %s", certs[0].Subject.CommonName, err.Error())
+		return nil
+	}
+	name := certs[0].Subject.CommonName
+	if len(a.certs) == 0 {
+		return &credential{name: name, permissions: allPermissions}
+	}
+	if cred, ok := a.certs[name]; ok {
+		return cred
+	}
+	log.Debugf("Client certificate %s is not listed in client_certs", name)
+	return nil
+}
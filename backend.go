@@ -0,0 +1,116 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackendOptions are settings shared by all backends
+type BackendOptions struct {
+	Name      string
+	Workers   int
+	BatchSize int
+}
+
+// BackendFactory creates an adapter from the typed config created by the backend registration
+type BackendFactory func(config interface{}, opts BackendOptions) (Adapter, error)
+
+type backendRegistration struct {
+	newConfig func() interface{}
+	factory   BackendFactory
+}
+
+var backends = make(map[string]backendRegistration)
+
+// RegisterBackend makes a backend available in config under the given type,
+// newConfig must return a pointer to the backend config to unmarshal yaml into.
+func RegisterBackend(backendType string, newConfig func() interface{}, factory BackendFactory) {
+	if _, ok := backends[backendType]; ok {
+		panic(fmt.Sprintf("backend %s is already registered", backendType))
+	}
+	backends[backendType] = backendRegistration{newConfig, factory}
+}
+
+func backendTypes() []string {
+	types := make([]string, 0, len(backends))
+	for t := range backends {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// BackendConfig holds the typed config of a backend and the settings common to all backends,
+// common settings left empty are set from top-level config.
+type BackendConfig struct {
+	Type           string                `yaml:"type"`
+	Name           string                `yaml:"name"`
+	Workers        int                   `yaml:"workers"`
+	BatchSize      int                   `yaml:"batch_size"`
+	Queue          *QueueConfig          `yaml:"queue"`
+	Retry          *RetryConfig          `yaml:"retry"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	ReadTimeout    time.Duration         `yaml:"read_timeout"`
+	NoRead         bool                  `yaml:"no_read"`
+	Config         interface{}           `yaml:"-"`
+}
+
+// backendCommonKeys are the keys of BackendConfig which are not part of typed config
+var backendCommonKeys = []string{"type", "name", "workers", "batch_size", "queue", "retry", "circuit_breaker", "read_timeout", "no_read"}
+
+func (c *BackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain BackendConfig
+	var backendType plain
+	if err := unmarshal(&backendType); err != nil {
+		return err
+	}
+	if backendType.Type == "" {
+		return fmt.Errorf("Config backend: type must be set (one of %s)", strings.Join(backendTypes(), ", "))
+	}
+	registration, ok := backends[backendType.Type]
+	if !ok {
+		return fmt.Errorf(
+			"Config backend: unknown type %s (one of %s)",
+			backendType.Type, strings.Join(backendTypes(), ", "),
+		)
+	}
+	config := registration.newConfig()
+	if err := unmarshal(config); err != nil {
+		return err
+	}
+	*c = BackendConfig(backendType)
+	c.Config = config
+	return nil
+}
+
+func NewBackend(config BackendConfig, opts BackendOptions) (Adapter, error) {
+	registration, ok := backends[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend type %s", config.Type)
+	}
+	return registration.factory(config.Config, opts)
+}
+
+// checkBackendOverflow is checkOverflow for backend configs which receive the common fields too
+func checkBackendOverflow(m map[string]interface{}, ctx string) error {
+	for _, k := range backendCommonKeys {
+		delete(m, k)
+	}
+	return checkOverflow(m, ctx)
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, tsdb is considered as down")
+
+var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+	FailureThreshold:    5,
+	OpenTimeout:         30 * time.Second,
+	HalfOpenMaxRequests: 1,
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold    int                    `yaml:"failure_threshold"`
+	OpenTimeout         time.Duration          `yaml:"open_timeout"`
+	HalfOpenMaxRequests int                    `yaml:"half_open_max_requests"`
+	XXX                 map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *CircuitBreakerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultCircuitBreakerConfig
+	type plain CircuitBreakerConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.OpenTimeout <= 0 {
+		return fmt.Errorf("Config circuit_breaker: open_timeout must be greater than 0")
+	}
+	if c.HalfOpenMaxRequests <= 0 {
+		c.HalfOpenMaxRequests = 1
+	}
+	return checkOverflow(c.XXX, "Config circuit_breaker")
+}
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker opens after too many consecutive failures of the tsdb and then fails fast.
+// Once open timeout is elapsed it goes half-open and lets few requests probe the tsdb,
+// it closes again on success or goes back to open on failure.
+// A failure threshold of 0 disables the circuit breaker.
+type CircuitBreaker struct {
+	config   CircuitBreakerConfig
+	name     string
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config: config,
+		name:   name,
+	}
+}
+
+// Allow returns ErrCircuitOpen when a call to the tsdb must not be done,
+// the result of an allowed call must be given to Report.
+func (b *CircuitBreaker) Allow() error {
+	if b.config.FailureThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		log.Infof("Circuit breaker for %s is now half-open, probing tsdb.", b.name)
+		b.state = stateHalfOpen
+		b.probes = 0
+		fallthrough
+	case stateHalfOpen:
+		if b.probes >= b.config.HalfOpenMaxRequests {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Report(success bool) {
+	if b.config.FailureThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if !success {
+			b.trip()
+			return
+		}
+		log.Infof("Circuit breaker for %s is now closed, tsdb has recovered.", b.name)
+		b.state = stateClosed
+		b.failures = 0
+	case stateClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.trip()
+		}
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	if b.config.FailureThreshold <= 0 {
+		return "disabled"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
+
+// trip opens the circuit, lock must be held
+func (b *CircuitBreaker) trip() {
+	log.Warnf("Circuit breaker for %s is now open for %s.", b.name, b.config.OpenTimeout.String())
+	b.state = stateOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+}
@@ -0,0 +1,409 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configErrorLineRegex matches errors of yaml which start with their line
+var configErrorLineRegex = regexp.MustCompile(`^(yaml: )?line (\d+): (.*)$`)
+
+// configIssue is an error found in config, line and column start at 1 and are 0 when the place is unknown
+type configIssue struct {
+	line    int
+	column  int
+	message string
+}
+
+func (i configIssue) format(file string) string {
+	if i.line == 0 {
+		return fmt.Sprintf("%s: %s", file, i.message)
+	}
+	if i.column == 0 {
+		return fmt.Sprintf("%s:%d: %s", file, i.line, i.message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", file, i.line, i.column, i.message)
+}
+
+// checkConfigCommand validates config without starting the server, it exits with 1 when config is invalid
+// or when a backend can't be reached with -check-backends
+func checkConfigCommand(args []string) int {
+	var configPath string
+	var sets stringsFlag
+	var withBackends bool
+	var timeout time.Duration
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "Set config file path (default to $PFR_CONFIG or config.yml).")
+	flags.Var(&sets, "set", "Set a config field, overriding config file and PFR_* environment variables (e.g. -set read.timeout=1m), can be repeated.")
+	flags.BoolVar(&withBackends, "check-backends", false, "Check that each backend answers its health check.")
+	flags.DurationVar(&timeout, "timeout", 10*time.Second, "Time given to each backend to answer with -check-backends.")
+	flags.Parse(args)
+
+	source := NewConfigSource(configPath, sets)
+	config, issues := source.check()
+	for _, i := range issues {
+		fmt.Fprintln(os.Stderr, i.format(source.File))
+	}
+	if len(issues) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: config is invalid, %d error(s) found\n", source.File, len(issues))
+		return 1
+	}
+	fmt.Printf("%s: config is valid\n", source.File)
+	if withBackends && !checkBackends(config, timeout) {
+		return 1
+	}
+	return 0
+}
+
+// check loads config like the server does but reports every unknown field and every invalid section at
+// their place, files referenced by config are read too
+func (s ConfigSource) check() (*Config, []configIssue) {
+	raw, err := s.readFile()
+	if err != nil {
+		return nil, []configIssue{{message: err.Error()}}
+	}
+	if issues := unsetEnvVars(raw); len(issues) > 0 {
+		return nil, issues
+	}
+	content, err := expandEnv(raw)
+	if err != nil {
+		return nil, []configIssue{{message: err.Error()}}
+	}
+	doc, err := parseConfigDocument(content)
+	if err != nil {
+		return nil, []configIssue{yamlErrorIssue(err.Error())}
+	}
+	overrides, err := s.overrides()
+	if err != nil {
+		return nil, []configIssue{{message: err.Error()}}
+	}
+	if len(overrides) > 0 {
+		if err := applyConfigOverrides(doc, overrides); err != nil {
+			return nil, []configIssue{{message: err.Error()}}
+		}
+		if content, err = yaml.Marshal(doc); err != nil {
+			return nil, []configIssue{{message: err.Error()}}
+		}
+	}
+	issues := checkConfigFields(doc, reflect.TypeOf(Config{}), nil)
+	if len(issues) > 0 {
+		sortConfigIssues(issues)
+		return nil, issues
+	}
+	// errors between sections, which have no place, are looked for once every section is valid
+	config, err := Load(string(content))
+	if err != nil {
+		return nil, loadErrorIssues(err, nil)
+	}
+	issues = checkConfigFiles(config)
+	sortConfigIssues(issues)
+	return config, issues
+}
+
+// checkConfigFiles reads certificates and htpasswd file given in config
+func checkConfigFiles(config *Config) []configIssue {
+	var issues []configIssue
+	if config.ListenTLS != nil {
+		if err := (&certReloader{config: *config.ListenTLS}).load(); err != nil {
+			issues = append(issues, configIssue{message: "Config listen_tls: " + strings.TrimPrefix(err.Error(), "listen_tls: ")})
+		}
+	}
+	if config.Auth != nil {
+		if _, err := NewAuthenticator(*config.Auth); err != nil {
+			issues = append(issues, configIssue{message: "Config auth: " + strings.TrimPrefix(err.Error(), "auth: ")})
+		}
+	}
+	return issues
+}
+
+// checkBackends tells if every backend answers its health check before timeout
+func checkBackends(config *Config, timeout time.Duration) bool {
+	ok := true
+	check := func(name string, b *BackendConfig) {
+		adapter, err := NewBackend(*b, BackendOptions{Name: b.Name, Workers: b.Workers, BatchSize: b.BatchSize})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			ok = false
+			return
+		}
+		healthy := make(chan bool, 1)
+		go func() {
+			healthy <- adapter.Healthy()
+		}()
+		select {
+		case h := <-healthy:
+			if h {
+				fmt.Printf("%s: healthy\n", name)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s: unhealthy\n", name)
+		case <-time.After(timeout):
+			fmt.Fprintf(os.Stderr, "%s: no answer after %s\n", name, timeout)
+		}
+		ok = false
+	}
+	for _, b := range config.Backends {
+		check(fmt.Sprintf("backend %s (%s)", b.Name, b.Type), b)
+	}
+	for _, t := range config.Tenants {
+		for _, b := range t.Backends {
+			check(fmt.Sprintf("tenant %s backend %s (%s)", t.Name, b.Name, b.Type), b)
+		}
+	}
+	return ok
+}
+
+// checkConfigFields reports fields of section node which are not yaml fields of type t and checks their values,
+// fields of a backend are the common ones and the ones of its type
+func checkConfigFields(node *yaml.Node, t reflect.Type, path []string) []configIssue {
+	fields, ok := configFields(node, t)
+	if !ok {
+		// unknown types are reported when the backend is loaded
+		return nil
+	}
+	var issues []configIssue
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.ShortTag() == "!!merge" {
+			for _, merged := range mergedConfigNodes(value) {
+				issues = append(issues, checkConfigFields(merged, t, path)...)
+			}
+			continue
+		}
+		field, ok := fields[key.Value]
+		if !ok {
+			section := strings.Join(path, ".")
+			if section != "" {
+				section = " " + section
+			}
+			issues = append(issues, configIssue{
+				line:    key.Line,
+				column:  key.Column,
+				message: fmt.Sprintf("Config%s: unknown field %s", section, key.Value),
+			})
+			continue
+		}
+		issues = append(issues, checkConfigValue(value, key, field, appendPath(path, key.Value))...)
+	}
+	return issues
+}
+
+// checkConfigValue checks that node can be loaded in type t, place is the key of node or node itself in a list.
+// Lists and maps are checked element by element and sections field by field, a section is loaded once its
+// fields are valid so that each error is reported at the place of the innermost section it comes from.
+func checkConfigValue(node, place *yaml.Node, t reflect.Type, path []string) []configIssue {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	elem := t
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	var issues []configIssue
+	switch {
+	case elem.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			issues = append(issues, checkConfigValue(item, item, elem.Elem(), appendPath(path, strconv.Itoa(i)))...)
+		}
+		return issues
+	case elem.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			issues = append(issues, checkConfigValue(node.Content[i+1], key, elem.Elem(), appendPath(path, key.Value))...)
+		}
+		return issues
+	case elem.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		issues = checkConfigFields(node, elem, path)
+		if len(issues) > 0 {
+			return issues
+		}
+	}
+	content, err := yaml.Marshal(withoutAliases(node))
+	if err != nil {
+		return []configIssue{{line: place.Line, column: place.Column, message: err.Error()}}
+	}
+	// config is loaded by yaml.v2, values are loaded the same way to get the same errors
+	issues = loadErrorIssues(yamlv2.Unmarshal(content, reflect.New(t).Interface()), place)
+	if elem.Kind() != reflect.Struct {
+		// errors of sections tell which section they come from, the ones of other values don't
+		for i := range issues {
+			issues[i].message = fmt.Sprintf("Config %s: %s", strings.Join(path, "."), issues[i].message)
+		}
+	}
+	return issues
+}
+
+// configFields gives type of fields of section node of type t by their yaml name, fields of a backend are
+// the common ones and the ones of its type, false is returned when the type of the backend is unknown
+func configFields(node *yaml.Node, t reflect.Type) (map[string]reflect.Type, bool) {
+	fields := yamlFields(t)
+	if t != reflect.TypeOf(BackendConfig{}) {
+		return fields, true
+	}
+	registration, ok := backends[configFieldValue(node, "type")]
+	if !ok {
+		return fields, false
+	}
+	for k, v := range yamlFields(reflect.TypeOf(registration.newConfig()).Elem()) {
+		fields[k] = v
+	}
+	return fields, true
+}
+
+// configFieldValue gives the value of field key of section node, it is empty when it is not set
+func configFieldValue(node *yaml.Node, key string) string {
+	if value := configFieldNode(node, key); value != nil && value.Kind == yaml.ScalarNode {
+		return value.Value
+	}
+	return ""
+}
+
+// mergedConfigNodes gives the sections of a merge key, which is <<: *section or <<: [*section, ...]
+func mergedConfigNodes(node *yaml.Node) []*yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.SequenceNode {
+		return []*yaml.Node{node}
+	}
+	var merged []*yaml.Node
+	for _, n := range node.Content {
+		merged = append(merged, mergedConfigNodes(n)...)
+	}
+	return merged
+}
+
+// loadErrorIssues places errors of loading at place, lines given by yaml are left out as they are the ones
+// of the value loaded alone
+func loadErrorIssues(err error, place *yaml.Node) []configIssue {
+	if err == nil {
+		return nil
+	}
+	messages := []string{err.Error()}
+	if e, ok := err.(*yamlv2.TypeError); ok {
+		messages = e.Errors
+	}
+	var issues []configIssue
+	for _, message := range messages {
+		if m := configErrorLineRegex.FindStringSubmatch(message); m != nil {
+			message = m[1] + m[3]
+		}
+		issue := configIssue{message: message}
+		if place != nil {
+			issue.line, issue.column = place.Line, place.Column
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// yamlErrorIssue places a syntax error of yaml, which starts with its line, at this line
+func yamlErrorIssue(message string) configIssue {
+	m := configErrorLineRegex.FindStringSubmatch(message)
+	if m == nil {
+		return configIssue{message: message}
+	}
+	line, _ := strconv.Atoi(m[2])
+	return configIssue{line: line, message: m[1] + m[3]}
+}
+
+// unsetEnvVars reports each ${VAR} of config file which has no default and is not set in environment
+func unsetEnvVars(content []byte) []configIssue {
+	var issues []configIssue
+	lines := strings.Split(string(content), "\n")
+	comments := configComments(lines)
+	for n, line := range lines {
+		if comments[n] >= 0 {
+			line = line[:comments[n]]
+		}
+		for _, m := range envVarRegex.FindAllStringSubmatchIndex(line, -1) {
+			if line[m[0]+1] == '$' || m[4] >= 0 {
+				continue
+			}
+			name := line[m[2]:m[3]]
+			if _, ok := os.LookupEnv(name); ok {
+				continue
+			}
+			issues = append(issues, configIssue{
+				line:    n + 1,
+				column:  m[0] + 1,
+				message: fmt.Sprintf("Config: environment variable %s is not set, use ${%s:-} to allow it", name, name),
+			})
+		}
+	}
+	return issues
+}
+
+// yamlFields gives type of fields by their yaml name, catch-all inline maps are left out
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range parts[1:] {
+			inline = inline || flag == "inline"
+		}
+		if inline {
+			if f.Type.Kind() == reflect.Struct {
+				for k, v := range yamlFields(f.Type) {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+		name := parts[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func appendPath(path []string, key string) []string {
+	return append(append([]string{}, path...), key)
+}
+
+func sortConfigIssues(issues []configIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.line == 0 || b.line == 0 {
+			return a.line != 0 && b.line == 0
+		}
+		if a.line != b.line {
+			return a.line < b.line
+		}
+		return a.column < b.column
+	})
+}
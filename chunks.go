@@ -0,0 +1,269 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxSamplesPerChunk is the size of chunks made by prometheus
+	maxSamplesPerChunk = 120
+	// maxFrameBytes is the size from which a series is split over several frames
+	maxFrameBytes = 1024 * 1024
+
+	streamedChunksContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+// chunkedWriter writes frames of streamed remote read response, each frame is the size of the message
+// as uvarint, its crc32 castagnoli checksum and the message.
+type chunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newChunkedWriter(w io.Writer) *chunkedWriter {
+	flusher, _ := w.(http.Flusher)
+	return &chunkedWriter{w, flusher}
+}
+
+func (c *chunkedWriter) writeFrame(resp *prompb.ChunkedReadResponse) error {
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, crcTable))
+	if _, err = c.w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	if _, err = c.w.Write(data); err != nil {
+		return err
+	}
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return nil
+}
+
+// writeSeries sorts series by labels, as prometheus expects them, and sends each series in its own frames
+func (c *chunkedWriter) writeSeries(queryIndex int64, series []*prompb.ChunkedSeries) error {
+	sort.Slice(series, func(i, j int) bool {
+		return compareLabels(series[i].Labels, series[j].Labels) < 0
+	})
+	for _, s := range series {
+		chunked := &prompb.ChunkedSeries{Labels: s.Labels}
+		frameSize := 0
+		for _, chunk := range s.Chunks {
+			chunked.Chunks = append(chunked.Chunks, chunk)
+			frameSize += len(chunk.Data)
+			if frameSize < maxFrameBytes {
+				continue
+			}
+			if err := c.writeChunkedSeries(queryIndex, chunked); err != nil {
+				return err
+			}
+			chunked = &prompb.ChunkedSeries{Labels: s.Labels}
+			frameSize = 0
+		}
+		if len(chunked.Chunks) == 0 {
+			continue
+		}
+		if err := c.writeChunkedSeries(queryIndex, chunked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chunkedWriter) writeChunkedSeries(queryIndex int64, chunked *prompb.ChunkedSeries) error {
+	return c.writeFrame(&prompb.ChunkedReadResponse{
+		ChunkedSeries: []*prompb.ChunkedSeries{chunked},
+		QueryIndex:    queryIndex,
+	})
+}
+
+// encodeSeries sorts labels of the series and encodes its samples in xor chunks
+func encodeSeries(ts *prompb.TimeSeries) *prompb.ChunkedSeries {
+	sort.Slice(ts.Labels, func(i, j int) bool {
+		return ts.Labels[i].Name < ts.Labels[j].Name
+	})
+	chunked := &prompb.ChunkedSeries{
+		Labels: ts.Labels,
+		Chunks: make([]prompb.Chunk, 0, (len(ts.Samples)+maxSamplesPerChunk-1)/maxSamplesPerChunk),
+	}
+	for i := 0; i < len(ts.Samples); i += maxSamplesPerChunk {
+		end := i + maxSamplesPerChunk
+		if end > len(ts.Samples) {
+			end = len(ts.Samples)
+		}
+		chunked.Chunks = append(chunked.Chunks, encodeXORChunk(ts.Samples[i:end]))
+	}
+	return chunked
+}
+
+func compareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// encodeXORChunk encodes samples sorted by time in the gorilla xor format used by prometheus:
+// number of samples on 2 bytes followed by timestamps as delta of delta and values xored with previous one.
+func encodeXORChunk(samples []prompb.Sample) prompb.Chunk {
+	b := &bstream{stream: make([]byte, 2, 2+len(samples)*2)}
+	var t, tDelta int64
+	var v float64
+	leading, trailing := uint8(0xff), uint8(0)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i, s := range samples {
+		switch i {
+		case 0:
+			for _, c := range buf[:binary.PutVarint(buf, s.Timestamp)] {
+				b.writeByte(c)
+			}
+			b.writeBits(math.Float64bits(s.Value), 64)
+		case 1:
+			tDelta = s.Timestamp - t
+			for _, c := range buf[:binary.PutUvarint(buf, uint64(tDelta))] {
+				b.writeByte(c)
+			}
+			b.writeXOR(s.Value, v, &leading, &trailing)
+		default:
+			newDelta := s.Timestamp - t
+			dod := newDelta - tDelta
+			switch {
+			case dod == 0:
+				b.writeBit(false)
+			case bitRange(dod, 14):
+				b.writeBits(0x02, 2)
+				b.writeBits(uint64(dod), 14)
+			case bitRange(dod, 17):
+				b.writeBits(0x06, 3)
+				b.writeBits(uint64(dod), 17)
+			case bitRange(dod, 20):
+				b.writeBits(0x0e, 4)
+				b.writeBits(uint64(dod), 20)
+			default:
+				b.writeBits(0x0f, 4)
+				b.writeBits(uint64(dod), 64)
+			}
+			tDelta = newDelta
+			b.writeXOR(s.Value, v, &leading, &trailing)
+		}
+		t, v = s.Timestamp, s.Value
+	}
+	binary.BigEndian.PutUint16(b.stream, uint16(len(samples)))
+	chunk := prompb.Chunk{
+		Type: prompb.Chunk_XOR,
+		Data: b.stream,
+	}
+	if len(samples) > 0 {
+		chunk.MinTimeMs = samples[0].Timestamp
+		chunk.MaxTimeMs = samples[len(samples)-1].Timestamp
+	}
+	return chunk
+}
+
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// bstream is a stream of bits written from the most significant bit of each byte
+type bstream struct {
+	stream []byte
+	count  uint8 // number of bits available in last byte
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+// writeBits writes the nbits lowest bits of u
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+func (b *bstream) writeXOR(value, previous float64, leading, trailing *uint8) {
+	delta := math.Float64bits(value) ^ math.Float64bits(previous)
+	if delta == 0 {
+		b.writeBit(false)
+		return
+	}
+	b.writeBit(true)
+
+	newLeading := uint8(bits.LeadingZeros64(delta))
+	newTrailing := uint8(bits.TrailingZeros64(delta))
+	// leading zeros count is written on 5 bits
+	if newLeading >= 32 {
+		newLeading = 31
+	}
+	if *leading != 0xff && newLeading >= *leading && newTrailing >= *trailing {
+		// meaningful bits fit in the previous window
+		b.writeBit(false)
+		b.writeBits(delta>>*trailing, 64-int(*leading)-int(*trailing))
+		return
+	}
+	*leading, *trailing = newLeading, newTrailing
+	b.writeBit(true)
+	b.writeBits(uint64(newLeading), 5)
+	// 64 meaningful bits are written as 0 and read back as 64
+	sigbits := 64 - newLeading - newTrailing
+	b.writeBits(uint64(sigbits), 6)
+	b.writeBits(delta>>newTrailing, int(sigbits))
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"math"
+	"testing"
+)
+
+// TestEncodeXORChunk decodes chunks with the XOR decoder of prometheus tsdb
+func TestEncodeXORChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []prompb.Sample
+	}{
+		{"one sample", []prompb.Sample{{Timestamp: 1000, Value: 1.5}}},
+		{"two samples", []prompb.Sample{{Timestamp: -1000, Value: 1}, {Timestamp: 5000, Value: -2}}},
+		{"regular interval", []prompb.Sample{
+			{Timestamp: 0, Value: 1}, {Timestamp: 15000, Value: 1}, {Timestamp: 30000, Value: 1}, {Timestamp: 45000, Value: 2},
+		}},
+		{"delta of delta ranges", []prompb.Sample{
+			{Timestamp: 0, Value: 0},
+			{Timestamp: 10, Value: 1},
+			{Timestamp: 20, Value: 2},
+			{Timestamp: 8000, Value: 3},               // 14 bits
+			{Timestamp: 80000, Value: 4},              // 17 bits
+			{Timestamp: 600000, Value: 5},             // 20 bits
+			{Timestamp: 10000000000, Value: 6},        // 64 bits
+			{Timestamp: 10000000001, Value: 7},        // negative
+			{Timestamp: 10000000001 + 8193, Value: 8}, // 14 bits upper bound
+		}},
+		{"values", []prompb.Sample{
+			{Timestamp: 1, Value: 0},
+			{Timestamp: 2, Value: math.MaxFloat64},
+			{Timestamp: 3, Value: -math.SmallestNonzeroFloat64},
+			{Timestamp: 4, Value: math.Inf(1)},
+			{Timestamp: 5, Value: math.Float64frombits(staleNaN)},
+			{Timestamp: 6, Value: 123456.789},
+			{Timestamp: 7, Value: 123456.789},
+			{Timestamp: 8, Value: 0.1},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunk := encodeXORChunk(test.samples)
+			if chunk.MinTimeMs != test.samples[0].Timestamp || chunk.MaxTimeMs != test.samples[len(test.samples)-1].Timestamp {
+				t.Errorf("chunk time range is %d-%d", chunk.MinTimeMs, chunk.MaxTimeMs)
+			}
+			decoded, err := chunkenc.FromData(chunkenc.EncXOR, chunk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.NumSamples() != len(test.samples) {
+				t.Fatalf("chunk has %d samples, expected %d", decoded.NumSamples(), len(test.samples))
+			}
+			it := decoded.Iterator(nil)
+			for i, s := range test.samples {
+				if !it.Next() {
+					t.Fatalf("sample %d is missing: %v", i, it.Err())
+				}
+				ts, v := it.At()
+				if ts != s.Timestamp || math.Float64bits(v) != math.Float64bits(s.Value) {
+					t.Errorf("sample %d is %d %v, expected %d %v", i, ts, v, s.Timestamp, s.Value)
+				}
+			}
+			if it.Next() {
+				t.Error("chunk has more samples than encoded")
+			}
+		})
+	}
+}
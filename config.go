@@ -18,9 +18,10 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 func checkOverflow(m map[string]interface{}, ctx string) error {
@@ -41,37 +42,61 @@ func Load(s string) (*Config, error) {
 	}
 	return cfg, nil
 }
-func LoadFile(filename string) (*Config, error) {
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-	cfg, err := Load(string(content))
-	if err != nil {
-		return nil, err
-	}
 
-	return cfg, nil
+// LoadFile loads a config file with ${VAR} expanded and PFR_* environment variables applied
+func LoadFile(filename string) (*Config, error) {
+	return ConfigSource{File: filename}.Load()
 }
 
 type Config struct {
-	KairosUrl    string                 `yaml:"kairos_url"`
-	SkipInsecure bool                   `yaml:"skip_insecure"`
-	ListenAddr   string                 `yaml:"listen_addr"`
-	LogLevel     string                 `yaml:"log_level"`
-	LogJson      bool                   `yaml:"log_json"`
-	NoColor      bool                   `yaml:"no_color"`
-	Workers      int                    `yaml:"workers"`
-	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+	Backend         *BackendConfig         `yaml:"backend"`
+	Backends        []*BackendConfig       `yaml:"backends"`
+	KairosUrl       string                 `yaml:"kairos_url"`
+	SkipInsecure    bool                   `yaml:"skip_insecure"`
+	ListenAddr      string                 `yaml:"listen_addr"`
+	ListenTLS       *ListenTLSConfig       `yaml:"listen_tls"`
+	LogLevel        string                 `yaml:"log_level"`
+	LogJson         bool                   `yaml:"log_json"`
+	NoColor         bool                   `yaml:"no_color"`
+	Workers         int                    `yaml:"workers"`
+	BatchSize       int                    `yaml:"batch_size"`
+	ShutdownTimeout time.Duration          `yaml:"shutdown_timeout"`
+	Queue           *QueueConfig           `yaml:"queue"`
+	Retry           RetryConfig            `yaml:"retry"`
+	CircuitBreaker  CircuitBreakerConfig   `yaml:"circuit_breaker"`
+	Read            ReadConfig             `yaml:"read"`
+	Write           WriteConfig            `yaml:"write"`
+	TenantFrom      string                 `yaml:"tenant_from"`
+	TenantHeader    string                 `yaml:"tenant_header"`
+	Tenants         []*TenantConfig        `yaml:"tenants"`
+	Auth            *AuthConfig            `yaml:"auth"`
+	XXX             map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Retry = DefaultRetryConfig
+	c.CircuitBreaker = DefaultCircuitBreakerConfig
+	c.Read = DefaultReadConfig
+	c.Write = DefaultWriteConfig
 	type plain Config
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
-	if c.KairosUrl == "" {
-		return fmt.Errorf("Config: kairos_url must be set")
+	// kairos_url and skip_insecure are kept for configs made before backends selection
+	if c.Backend == nil && c.KairosUrl != "" {
+		c.Backend = &BackendConfig{
+			Type: "kairosdb",
+			Config: &KairosConfig{
+				Url:          c.KairosUrl,
+				SkipInsecure: c.SkipInsecure,
+			},
+		}
+	}
+	if c.Backend != nil {
+		c.Backends = append([]*BackendConfig{c.Backend}, c.Backends...)
+	}
+	if len(c.Backends) == 0 && len(c.Tenants) == 0 {
+		return fmt.Errorf("Config: backend or backends must be set")
 	}
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -86,13 +111,99 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.Workers <= 0 {
 		c.Workers = 5
 	}
-	err := checkOverflow(c.XXX, "Config")
+	if c.BatchSize <= 0 {
+		c.BatchSize = 1000
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 8 * time.Second
+	}
+	err := c.loadBackendsDefaults(c.Backends, c.Workers, c.BatchSize, "")
+	if err != nil {
+		return err
+	}
+	err = c.loadTenants()
 	if err != nil {
 		return err
 	}
-	c.loadLogConfig()
+	err = checkQueueDirs(c.allBackends())
+	if err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "Config")
+}
+
+// loadBackendsDefaults sets settings not given in a backend from top-level ones, workers and batch size
+// can come from a tenant. When several backends use top-level queue each one gets its own sub-directory
+// named after the backend, queueSubDir is added to top-level queue dir to separate tenants.
+// Backends after the first one must have a queue.
+func (c *Config) loadBackendsDefaults(backends []*BackendConfig, workers, batchSize int, queueSubDir string) error {
+	names := make(map[string]bool)
+	for i, b := range backends {
+		if b.Name == "" {
+			b.Name = b.Type
+		}
+		if names[b.Name] {
+			return fmt.Errorf("Config backends: name %s is used by several backends, set a name to each backend", b.Name)
+		}
+		names[b.Name] = true
+		if b.Workers <= 0 {
+			b.Workers = workers
+		}
+		if b.BatchSize <= 0 {
+			b.BatchSize = batchSize
+		}
+		if b.Retry == nil {
+			retry := c.Retry
+			b.Retry = &retry
+		}
+		if b.CircuitBreaker == nil {
+			breaker := c.CircuitBreaker
+			b.CircuitBreaker = &breaker
+		}
+		if b.ReadTimeout <= 0 {
+			b.ReadTimeout = c.Read.Timeout
+		}
+		if b.Queue == nil && c.Queue != nil {
+			queue := *c.Queue
+			queue.Dir = filepath.Join(queue.Dir, queueSubDir)
+			if len(backends) > 1 {
+				queue.Dir = filepath.Join(queue.Dir, b.Name)
+			}
+			b.Queue = &queue
+		}
+		// a backend without queue holds the response, only the first one may fail the write request of all others
+		if i > 0 && b.Queue == nil {
+			return fmt.Errorf("Config backend %s: queue must be set on every backend but the first one", b.Name)
+		}
+	}
+	return nil
+}
+
+// allBackends gives top-level backends and backends of tenants
+func (c *Config) allBackends() []*BackendConfig {
+	backends := append([]*BackendConfig{}, c.Backends...)
+	for _, t := range c.Tenants {
+		backends = append(backends, t.Backends...)
+	}
+	return backends
+}
+
+func checkQueueDirs(backends []*BackendConfig) error {
+	queueDirs := make(map[string]string)
+	for _, b := range backends {
+		if b.Queue == nil {
+			continue
+		}
+		dir := filepath.Clean(b.Queue.Dir)
+		if other, ok := queueDirs[dir]; ok {
+			return fmt.Errorf("Config backends: backends %s and %s use the same queue dir %s", other, b.Name, dir)
+		}
+		queueDirs[dir] = b.Name
+	}
 	return nil
 }
+
+// loadLogConfig sets up global logger, it is called when config is loaded and when it is reloaded
 func (c Config) loadLogConfig() {
 
 	if c.LogJson {
@@ -102,9 +213,6 @@ func (c Config) loadLogConfig() {
 			DisableColors: c.NoColor,
 		})
 	}
-	if c.LogLevel == "" {
-		return
-	}
 	switch strings.ToUpper(c.LogLevel) {
 	case "ERROR":
 		log.SetLevel(log.ErrorLevel)
@@ -121,5 +229,8 @@ func (c Config) loadLogConfig() {
 	case "FATAL":
 		log.SetLevel(log.FatalLevel)
 		return
+	default:
+		// a reloaded config without level goes back to default one
+		log.SetLevel(log.InfoLevel)
 	}
 }
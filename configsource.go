@@ -0,0 +1,389 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	envPrefix         = "PFR_"
+	envConfigFile     = envPrefix + "CONFIG"
+	defaultConfigFile = "config.yml"
+)
+
+// envVarRegex matches ${VAR} and ${VAR:-default}, $${ is kept as a literal ${
+var envVarRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// configBlockScalarRegex matches a line ending with the indicator of a block scalar, lines after it which are
+// more indented are the content of the scalar
+var configBlockScalarRegex = regexp.MustCompile(`(^|[\s:-])[|>][-+0-9]*\s*$`)
+
+// ConfigSource tells where config comes from, each one overrides the previous:
+// yaml file (with ${VAR} expanded from environment), PFR_* environment variables and -set flags
+type ConfigSource struct {
+	File string
+	// File may be missing when it is the default one, config then only comes from environment and flags
+	Optional bool
+	Sets     []string
+}
+
+// NewConfigSource uses config file given by flag, by PFR_CONFIG or config.yml in this order
+func NewConfigSource(file string, sets []string) ConfigSource {
+	if file != "" {
+		return ConfigSource{File: file, Sets: sets}
+	}
+	if file = os.Getenv(envConfigFile); file != "" {
+		return ConfigSource{File: file, Sets: sets}
+	}
+	return ConfigSource{File: defaultConfigFile, Optional: true, Sets: sets}
+}
+
+func (s ConfigSource) Load() (*Config, error) {
+	content, err := s.content()
+	if err != nil {
+		return nil, err
+	}
+	return Load(string(content))
+}
+
+// readFile gives config file as written, a missing optional file is empty
+func (s ConfigSource) readFile() ([]byte, error) {
+	content, err := ioutil.ReadFile(s.File)
+	if err != nil && !(s.Optional && os.IsNotExist(err)) {
+		return nil, err
+	}
+	return content, nil
+}
+
+// content gives config file with ${VAR} expanded and overrides applied, file is left as is
+// when there are no overrides so yaml errors keep their line numbers
+func (s ConfigSource) content() ([]byte, error) {
+	content, err := s.readFile()
+	if err != nil {
+		return nil, err
+	}
+	content, err = expandEnv(content)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := s.overrides()
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return content, nil
+	}
+	doc, err := parseConfigDocument(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyConfigOverrides(doc, overrides); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// parseConfigDocument gives the root node of config content, an empty content is an empty section
+func parseConfigDocument(content []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// applyConfigOverrides sets overrides in doc, nodes set this way have no line
+func applyConfigOverrides(doc *yaml.Node, overrides []configOverride) error {
+	for _, o := range overrides {
+		value := parseConfigValue(o.value, configFieldType(doc, reflect.TypeOf(Config{}), o.path))
+		if err := setConfigValue(doc, o.path, value); err != nil {
+			return fmt.Errorf("Config %s: %s", o.origin, err.Error())
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} by the value of environment variable VAR or by default value of ${VAR:-default},
+// a variable which is not set and has no default is an error. Comments are left as is.
+func expandEnv(content []byte) ([]byte, error) {
+	var err error
+	expand := func(match []byte) []byte {
+		if match[1] == '$' {
+			return match[1:]
+		}
+		sub := envVarRegex.FindSubmatch(match)
+		if value, ok := os.LookupEnv(string(sub[1])); ok {
+			return []byte(value)
+		}
+		if sub[2] != nil {
+			return sub[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("Config: environment variable %s is not set, use ${%s:-} to allow it", sub[1], sub[1])
+		}
+		return nil
+	}
+	lines := strings.Split(string(content), "\n")
+	comments := configComments(lines)
+	for n, line := range lines {
+		code, comment := line, ""
+		if comments[n] >= 0 {
+			code, comment = line[:comments[n]], line[comments[n]:]
+		}
+		lines[n] = string(envVarRegex.ReplaceAllFunc([]byte(code), expand)) + comment
+	}
+	return []byte(strings.Join(lines, "\n")), err
+}
+
+// configComments gives where the comment of each line starts, or -1 when it has none. A comment starts with #
+// at the beginning of a line or after a space, out of quoted strings and of block scalars (| or >).
+func configComments(lines []string) []int {
+	comments := make([]int, len(lines))
+	blockIndent := -1
+	for n, line := range lines {
+		comments[n] = -1
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if blockIndent >= 0 {
+			if strings.TrimSpace(text) == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		var quote byte
+	scan:
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case quote == '"' && c == '\\':
+				i++
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				// quotes only start a string at the beginning of a value, as in don't they are part of it
+				if i == 0 || strings.IndexByte(" \t:-[{,", line[i-1]) >= 0 {
+					quote = c
+				}
+			case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+				comments[n] = i
+				break scan
+			}
+		}
+		code := line
+		if comments[n] >= 0 {
+			code = line[:comments[n]]
+		}
+		if configBlockScalarRegex.MatchString(code) {
+			blockIndent = indent
+		}
+	}
+	return comments
+}
+
+type configOverride struct {
+	origin string
+	path   []string
+	value  string
+}
+
+// overrides gives PFR_* environment variables sorted by name then -set flags, nested fields are separated
+// by __ in variable names (PFR_READ__TIMEOUT) and by . in flags (read.timeout), list elements by their index
+func (s ConfigSource) overrides() ([]configOverride, error) {
+	var overrides []configOverride
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		name := kv[:i]
+		if !strings.HasPrefix(name, envPrefix) || name == envConfigFile {
+			continue
+		}
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, envPrefix)), "__")
+		overrides = append(overrides, configOverride{name, path, kv[i+1:]})
+	}
+	for _, set := range s.Sets {
+		i := strings.Index(set, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Config -set %s: field=value expected", set)
+		}
+		overrides = append(overrides, configOverride{"-set " + set[:i], strings.Split(set[:i], "."), set[i+1:]})
+	}
+	return overrides, nil
+}
+
+// parseConfigValue keeps value as a string for string fields and fields which don't exist, for other fields it is
+// read as yaml so numbers, booleans and lists get their type
+func parseConfigValue(s string, t reflect.Type) *yaml.Node {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	str := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s, Style: yaml.DoubleQuotedStyle}
+	if t == nil || t.Kind() == reflect.String {
+		return str
+	}
+	var doc yaml.Node
+	if s == "" || yaml.Unmarshal([]byte(s), &doc) != nil || len(doc.Content) == 0 || doc.Content[0].ShortTag() == "!!null" {
+		return str
+	}
+	value := withoutAliases(doc.Content[0])
+	clearConfigPositions(value)
+	return value
+}
+
+// configFieldType gives the type of the field at path below node of type t, it is nil when there is no such field
+func configFieldType(node *yaml.Node, t reflect.Type, path []string) reflect.Type {
+	for _, key := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		var child *yaml.Node
+		switch t.Kind() {
+		case reflect.Slice:
+			i, err := strconv.Atoi(key)
+			if err != nil {
+				return nil
+			}
+			if node != nil && node.Kind == yaml.SequenceNode && i >= 0 && i < len(node.Content) {
+				child = node.Content[i]
+			}
+			t = t.Elem()
+		case reflect.Map:
+			child = configFieldNode(node, key)
+			t = t.Elem()
+		case reflect.Struct:
+			fields, _ := configFields(node, t)
+			field, ok := fields[key]
+			if !ok {
+				return nil
+			}
+			child = configFieldNode(node, key)
+			t = field
+		default:
+			return nil
+		}
+		node = child
+	}
+	return t
+}
+
+// configFieldNode gives the value of field key of section node, it is nil when the field is not set
+func configFieldNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key {
+			continue
+		}
+		if node.Content[i+1].Kind == yaml.AliasNode {
+			return node.Content[i+1].Alias
+		}
+		return node.Content[i+1]
+	}
+	return nil
+}
+
+// clearConfigPositions removes line and column of node and of its content, which don't come from config file
+func clearConfigPositions(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, n := range node.Content {
+		clearConfigPositions(n)
+	}
+}
+
+// withoutAliases copies node with aliases replaced by the node they refer to so that it can be used alone
+func withoutAliases(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		return withoutAliases(node.Alias)
+	}
+	copied := *node
+	copied.Anchor = ""
+	copied.Content = nil
+	for _, n := range node.Content {
+		copied.Content = append(copied.Content, withoutAliases(n))
+	}
+	return &copied
+}
+
+// setConfigValue sets value at path below node, missing sections are created and an element can be added
+// at the end of a list
+func setConfigValue(node *yaml.Node, path []string, value *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		*node = *newConfigNode(path[0])
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				node.Content[i+1] = value
+				return nil
+			}
+			return setConfigValue(node.Content[i+1], path[1:], value)
+		}
+		child := value
+		if len(path) > 1 {
+			child = newConfigNode(path[1])
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[0]}, child)
+		if len(path) == 1 {
+			return nil
+		}
+		return setConfigValue(child, path[1:], value)
+	case yaml.SequenceNode:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > len(node.Content) {
+			return fmt.Errorf("%s is not an index of a list of %d elements", path[0], len(node.Content))
+		}
+		if i == len(node.Content) {
+			child := value
+			if len(path) > 1 {
+				child = newConfigNode(path[1])
+			}
+			node.Content = append(node.Content, child)
+		}
+		if len(path) == 1 {
+			node.Content[i] = value
+			return nil
+		}
+		return setConfigValue(node.Content[i], path[1:], value)
+	default:
+		return fmt.Errorf("%s can't be set in a field which is not a section", path[0])
+	}
+}
+
+// newConfigNode creates a list when path element is an index and a section otherwise
+func newConfigNode(key string) *yaml.Node {
+	if _, err := strconv.Atoi(key); err == nil {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// RecoverableError is returned by an adapter when the tsdb could not be reached or failed on its side,
+// sending the same data again later may succeed.
+type RecoverableError struct {
+	error
+}
+
+func NewRecoverableError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return RecoverableError{err}
+}
+
+// IsRecoverable tells if an error returned by an adapter should lead prometheus to retry.
+// Errors which are not marked as recoverable are considered as data rejected by the tsdb.
+func IsRecoverable(err error) bool {
+	_, ok := err.(RecoverableError)
+	return ok
+}
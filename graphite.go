@@ -0,0 +1,517 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphiteNameTag is the tag in which graphite gives the metric path
+const graphiteNameTag = "name"
+
+func init() {
+	RegisterBackend("graphite", func() interface{} { return &GraphiteConfig{} }, newGraphiteBackend)
+}
+
+type GraphiteConfig struct {
+	Address      string                 `yaml:"address"`
+	Protocol     string                 `yaml:"protocol"`
+	Prefix       string                 `yaml:"prefix"`
+	Template     string                 `yaml:"template"`
+	Tags         bool                   `yaml:"tags"`
+	RenderUrl    string                 `yaml:"render_url"`
+	Timeout      time.Duration          `yaml:"timeout"`
+	SkipInsecure bool                   `yaml:"skip_insecure"`
+	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *GraphiteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain GraphiteConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Address == "" {
+		return fmt.Errorf("Config backend graphite: address must be set")
+	}
+	if c.Protocol == "" {
+		c.Protocol = "plaintext"
+	}
+	if c.Protocol != "plaintext" && c.Protocol != "pickle" {
+		return fmt.Errorf("Config backend graphite: protocol must be plaintext or pickle")
+	}
+	if c.Template == "" {
+		c.Template = model.MetricNameLabel
+	}
+	for _, name := range strings.Split(c.Template, ".") {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("Config backend graphite: invalid label name '%s' in template", name)
+		}
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, ".") {
+		c.Prefix += "."
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	c.RenderUrl = strings.TrimSuffix(c.RenderUrl, "/")
+	return checkBackendOverflow(c.XXX, "Config backend graphite")
+}
+
+func newGraphiteBackend(config interface{}, opts BackendOptions) (Adapter, error) {
+	c := config.(*GraphiteConfig)
+	client := createClient(opts.Name, c.SkipInsecure, opts.Workers)
+	client.Timeout = c.Timeout
+	return NewGraphiteAdapter(*c, client, opts.BatchSize), nil
+}
+
+// GraphiteAdapter writes samples to carbon and reads them from graphite-web render api.
+// Metric path is made of prefix followed by values of labels listed in template, labels
+// not in template are set as tags when tags are enabled (graphite 1.1+) or else appended
+// to path as name and value pairs sorted by name.
+// Characters not allowed in a path node or a tag value are escaped as %XX with XX the
+// hex code of the byte.
+type GraphiteAdapter struct {
+	config    GraphiteConfig
+	template  []string
+	client    *http.Client
+	batchSize int
+}
+
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+type graphiteSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][]*json.Number  `json:"datapoints"`
+}
+
+func NewGraphiteAdapter(config GraphiteConfig, client *http.Client, batchSize int) *GraphiteAdapter {
+	return &GraphiteAdapter{
+		config:    config,
+		template:  strings.Split(config.Template, "."),
+		client:    client,
+		batchSize: batchSize,
+	}
+}
+
+func (a GraphiteAdapter) Write(samples model.Samples) (int, error) {
+	points := make([]graphitePoint, 0, a.batchSize)
+	written := 0
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Debug("Skipping sample, graphite doesn't support NaN or infinite value.")
+			samplesDropped.WithLabelValues("invalid_value").Inc()
+			continue
+		}
+		points = append(points, graphitePoint{
+			path:      a.metricPath(s.Metric),
+			value:     v,
+			timestamp: makeTimestamp(s.Timestamp),
+		})
+
+		if len(points) < a.batchSize {
+			continue
+		}
+		err := a.send(points)
+		if err != nil {
+			return written, err
+		}
+		written += len(points)
+		points = points[:0]
+	}
+	if len(points) == 0 {
+		return written, nil
+	}
+	if err := a.send(points); err != nil {
+		return written, err
+	}
+	return written + len(points), nil
+}
+
+func (a GraphiteAdapter) metricPath(m model.Metric) string {
+	var buf bytes.Buffer
+	buf.WriteString(a.config.Prefix)
+	inTemplate := make(map[model.LabelName]bool, len(a.template))
+	for i, name := range a.template {
+		if i > 0 {
+			buf.WriteByte('.')
+		}
+		value := m[model.LabelName(name)]
+		if value == "" {
+			value = "none"
+		}
+		buf.WriteString(graphiteEscape(string(value)))
+		inTemplate[model.LabelName(name)] = true
+	}
+
+	names := make([]string, 0, len(m))
+	for name, value := range m {
+		if inTemplate[name] || name == model.MetricNameLabel || value == "" {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if a.config.Tags {
+			buf.WriteString(";" + graphiteTagName(name) + "=")
+		} else {
+			buf.WriteString("." + name + ".")
+		}
+		buf.WriteString(graphiteEscape(string(m[model.LabelName(name)])))
+	}
+	return buf.String()
+}
+
+func (a GraphiteAdapter) send(points []graphitePoint) error {
+	var payload []byte
+	if a.config.Protocol == "pickle" {
+		payload = graphitePickle(points)
+	} else {
+		var buf bytes.Buffer
+		for _, p := range points {
+			fmt.Fprintf(&buf, "%s %s %d\n",
+				p.path, strconv.FormatFloat(p.value, 'f', -1, 64), p.timestamp/1000,
+			)
+		}
+		payload = buf.Bytes()
+	}
+
+	conn, err := net.DialTimeout("tcp", a.config.Address, a.config.Timeout)
+	if err != nil {
+		return NewRecoverableError(err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(a.config.Timeout))
+	_, err = conn.Write(payload)
+	if err != nil {
+		return NewRecoverableError(err)
+	}
+	return nil
+}
+
+func (a GraphiteAdapter) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	if a.config.RenderUrl == "" {
+		return nil, fmt.Errorf("graphite backend has no render_url set, read is not available")
+	}
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	for _, q := range req.Queries {
+		matchers, err := newLabelMatchers(q.Matchers)
+		if err != nil {
+			return nil, err
+		}
+		series, err := a.render(ctx, a.buildTargets(q), q.StartTimestampMs, q.EndTimestampMs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range series {
+			labels, ok := a.seriesToLabelPairs(s)
+			// render api can't express all matchers, results are filtered here
+			if !ok || !matchLabels(matchers, labels) {
+				continue
+			}
+			k := labelsKey(labels)
+			ts, ok := labelsToSeries[k]
+			if !ok {
+				ts = &prompb.TimeSeries{
+					Labels: labels,
+				}
+				labelsToSeries[k] = ts
+			}
+			ts.Samples = mergeSamples(ts.Samples, a.datapointsToSamples(s.Datapoints))
+		}
+	}
+
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{Timeseries: make([]*prompb.TimeSeries, 0, len(labelsToSeries))},
+		},
+	}
+	for _, ts := range labelsToSeries {
+		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	}
+	return &resp, nil
+}
+
+// buildTargets makes render targets which select a superset of the series matched by the query,
+// only matchers testing equality are used as other ones would apply on escaped values
+func (a GraphiteAdapter) buildTargets(q *prompb.Query) []string {
+	equals := make(map[string]string)
+	notEquals := make(map[string][]string)
+	for _, m := range q.Matchers {
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			equals[m.Name] = m.Value
+		case prompb.LabelMatcher_NEQ:
+			notEquals[m.Name] = append(notEquals[m.Name], m.Value)
+		}
+	}
+
+	if !a.config.Tags {
+		nodes := make([]string, 0, len(a.template))
+		for _, name := range a.template {
+			value, ok := equals[name]
+			if !ok {
+				nodes = append(nodes, "*")
+				continue
+			}
+			if value == "" {
+				value = "none"
+			}
+			nodes = append(nodes, graphiteEscape(value))
+		}
+		// labels not in template add name and value nodes after template ones, ** matches them
+		target := a.config.Prefix + strings.Join(nodes, ".")
+		return []string{target, target + ".**"}
+	}
+
+	nodes := make([]string, 0, len(a.template))
+	inTemplate := make(map[string]bool, len(a.template))
+	for _, name := range a.template {
+		inTemplate[name] = true
+		value, ok := equals[name]
+		if !ok {
+			nodes = append(nodes, `[^.]*`)
+			continue
+		}
+		if value == "" {
+			value = "none"
+		}
+		nodes = append(nodes, regexp.QuoteMeta(graphiteEscape(value)))
+	}
+	expressions := []string{
+		fmt.Sprintf("'name=~^%s%s$'", regexp.QuoteMeta(a.config.Prefix), strings.Join(nodes, `\.`)),
+	}
+	for name, value := range equals {
+		if inTemplate[name] || name == model.MetricNameLabel {
+			continue
+		}
+		expressions = append(expressions, fmt.Sprintf("'%s=%s'", graphiteTagName(name), graphiteEscape(value)))
+	}
+	for name, values := range notEquals {
+		if inTemplate[name] || name == model.MetricNameLabel {
+			continue
+		}
+		for _, value := range values {
+			expressions = append(expressions, fmt.Sprintf("'%s!=%s'", graphiteTagName(name), graphiteEscape(value)))
+		}
+	}
+	sort.Strings(expressions[1:])
+	return []string{"seriesByTag(" + strings.Join(expressions, ",") + ")"}
+}
+
+func (a GraphiteAdapter) render(ctx context.Context, targets []string, startMs, endMs int64) ([]graphiteSeries, error) {
+	params := url.Values{}
+	params["target"] = targets
+	params.Set("format", "json")
+	params.Set("from", strconv.FormatInt(startMs/1000, 10))
+	// until is exclusive in graphite
+	params.Set("until", strconv.FormatInt(endMs/1000+1, 10))
+	req, err := http.NewRequest(http.MethodGet, a.config.RenderUrl+"/render?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("graphite responded with status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return nil, NewRecoverableError(err)
+		}
+		return nil, err
+	}
+	var series []graphiteSeries
+	err = json.NewDecoder(resp.Body).Decode(&series)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	return series, nil
+}
+
+// seriesToLabelPairs gets back labels from the path of a series and from its tags,
+// it fails for paths which can't be made by the adapter
+func (a GraphiteAdapter) seriesToLabelPairs(s graphiteSeries) ([]prompb.Label, bool) {
+	path := s.Target
+	if name, ok := s.Tags[graphiteNameTag]; ok {
+		path = name
+	}
+	if !strings.HasPrefix(path, a.config.Prefix) {
+		return nil, false
+	}
+	nodes := strings.Split(strings.TrimPrefix(path, a.config.Prefix), ".")
+	if len(nodes) < len(a.template) || (len(nodes)-len(a.template))%2 == 1 {
+		return nil, false
+	}
+	pairs := make([]prompb.Label, 0, len(nodes)+len(s.Tags))
+	for i, node := range nodes {
+		if i < len(a.template) {
+			pairs = append(pairs, prompb.Label{
+				Name:  a.template[i],
+				Value: graphiteUnescape(node),
+			})
+			continue
+		}
+		// labels appended to path as name and value pairs
+		if (i-len(a.template))%2 == 1 {
+			if !model.LabelName(nodes[i-1]).IsValid() {
+				return nil, false
+			}
+			pairs = append(pairs, prompb.Label{
+				Name:  nodes[i-1],
+				Value: graphiteUnescape(node),
+			})
+		}
+	}
+	for name, value := range s.Tags {
+		if name == graphiteNameTag {
+			continue
+		}
+		pairs = append(pairs, prompb.Label{
+			Name:  graphiteLabelName(name),
+			Value: graphiteUnescape(value),
+		})
+	}
+	return pairs, true
+}
+
+func (GraphiteAdapter) datapointsToSamples(datapoints [][]*json.Number) []prompb.Sample {
+	samples := make([]prompb.Sample, 0, len(datapoints))
+	for _, dp := range datapoints {
+		// graphite gives null for steps without value
+		if len(dp) != 2 || dp[0] == nil || dp[1] == nil {
+			continue
+		}
+		value, err := dp[0].Float64()
+		if err != nil {
+			continue
+		}
+		timestamp, err := dp[1].Int64()
+		if err != nil {
+			continue
+		}
+		samples = append(samples, prompb.Sample{
+			Timestamp: timestamp * 1000,
+			Value:     value,
+		})
+	}
+	return samples
+}
+
+func (a GraphiteAdapter) Healthy() bool {
+	conn, err := net.DialTimeout("tcp", a.config.Address, a.config.Timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (a GraphiteAdapter) Name() string {
+	return "graphite"
+}
+
+// graphitePickle encodes points as a list of (path, (timestamp, value)) in pickle protocol 2
+// prefixed by its length as expected by carbon pickle receiver.
+func graphitePickle(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.Write([]byte{0x80, 2})  // PROTO 2
+	buf.Write([]byte{']', '('}) // EMPTY_LIST, MARK
+	b := make([]byte, 8)
+	for _, p := range points {
+		buf.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(b, uint32(len(p.path)))
+		buf.Write(b[:4])
+		buf.WriteString(p.path)
+		buf.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(b, math.Float64bits(float64(p.timestamp)/1000))
+		buf.Write(b)
+		buf.WriteByte('G')
+		binary.BigEndian.PutUint64(b, math.Float64bits(p.value))
+		buf.Write(b)
+		buf.Write([]byte{0x86, 0x86}) // TUPLE2 for datapoint then for (path, datapoint)
+	}
+	buf.Write([]byte{'e', '.'}) // APPENDS, STOP
+	payload := buf.Bytes()
+	binary.BigEndian.PutUint32(payload[0:4], uint32(len(payload)-4))
+	return payload
+}
+
+// graphiteTagName adds an underscore to labels named name, _name, __name... so that they don't override
+// the name tag which graphite reserves for the metric path
+func graphiteTagName(label string) string {
+	if strings.TrimLeft(label, "_") == graphiteNameTag {
+		return "_" + label
+	}
+	return label
+}
+
+// graphiteLabelName gives back the label of a tag made by graphiteTagName
+func graphiteLabelName(tag string) string {
+	if strings.TrimLeft(tag, "_") == graphiteNameTag && tag != graphiteNameTag {
+		return tag[1:]
+	}
+	return tag
+}
+
+// graphiteEscape keeps characters allowed in a graphite path node and escapes other ones
+func graphiteEscape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '_' || c == ':' || c == '-' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func graphiteUnescape(s string) string {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
@@ -15,62 +15,120 @@
 package main
 
 import (
-	"github.com/golang/protobuf/proto"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/common/model"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/prompb"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"encoding/json"
 )
 
 type adapterHandler struct {
-	adapter Adapter
-	workers int
+	backends     []*BackendWriter
+	readConfig   ReadConfig
+	writeConfig  WriteConfig
+	metadata     *metadataStore
+	tenant       string
+	metricPrefix string
+	limiter      *rateLimiter
+	auth         *Authenticator
 }
 
 type HealthResponse struct {
-	Adapter string             `json:"adapter"`
-	Tsdb    TsdbHealthResponse `json:"tsdb"`
+	Adapter string               `json:"adapter"`
+	Tsdbs   []TsdbHealthResponse `json:"tsdbs"`
 }
 
 type TsdbHealthResponse struct {
-	Name   string `json:"name"`
-	Status string `json:"status"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Status         string `json:"status"`
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+}
+
+// breakerStater is implemented by adapters protected by a circuit breaker
+type breakerStater interface {
+	BreakerState() string
+}
+
+// NewAdapterHandler serves remote write and read, writes are sent to every backend
+// and reads are federated across backends not set with no_read, auth may be nil to serve anyone
+func NewAdapterHandler(backends []*BackendWriter, readConfig ReadConfig, writeConfig WriteConfig, auth *Authenticator) http.Handler {
+	h := newAdapterHandler(backends, readConfig, writeConfig)
+	h.auth = auth
+	return h.routes()
 }
 
-func NewAdapterHandler(adapter Adapter, workers int) http.Handler {
-	adaptHandler := &adapterHandler{adapter, workers}
+func newAdapterHandler(backends []*BackendWriter, readConfig ReadConfig, writeConfig WriteConfig) *adapterHandler {
+	return &adapterHandler{
+		backends:    backends,
+		readConfig:  readConfig,
+		writeConfig: writeConfig,
+		metadata:    newMetadataStore(),
+	}
+}
+
+func (adaptHandler *adapterHandler) routes() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/write", adaptHandler.write)
-	r.HandleFunc("/read", adaptHandler.read)
+	// influxdb v1 clients also write to /write but always set db parameter
+	auth := adaptHandler.auth
+	r.Handle("/write", instrumentHandler("influx", auth.require(permissionWrite, adaptHandler.influxWrite))).Queries("db", "")
+	r.Handle("/write", instrumentHandler("write", auth.require(permissionWrite, adaptHandler.write)))
+	r.Handle("/api/v2/write", instrumentHandler("influx", auth.require(permissionWrite, adaptHandler.influxWrite)))
+	r.HandleFunc("/ping", adaptHandler.ping)
+	r.Handle("/read", instrumentHandler("read", auth.require(permissionRead, adaptHandler.read)))
+	r.Handle("/v1/metrics", instrumentHandler("otlp", auth.require(permissionWrite, adaptHandler.otlpWrite)))
+	r.Handle("/api/v1/metadata", auth.require(permissionRead, adaptHandler.metadata.ServeHTTP))
 	r.HandleFunc("/health", adaptHandler.health)
+	r.Handle("/metrics", promhttp.Handler())
 	return r
 }
 
 func (h adapterHandler) health(w http.ResponseWriter, r *http.Request) {
-	healthy := h.adapter.Healthy()
 	statusCode := http.StatusOK
-	status := "ok"
-	if !healthy {
-		status = "ko"
-		statusCode = http.StatusInternalServerError
+	tsdbsHealth := make([]TsdbHealthResponse, len(h.backends))
+	var wg sync.WaitGroup
+	for i, b := range h.backends {
+		wg.Add(1)
+		go func(i int, b *BackendWriter) {
+			defer wg.Done()
+			tsdbHealth := TsdbHealthResponse{
+				Name:   b.Name(),
+				Type:   b.Adapter().Name(),
+				Status: "ok",
+			}
+			if !b.Adapter().Healthy() {
+				tsdbHealth.Status = "ko"
+			}
+			if breaker, ok := b.Adapter().(breakerStater); ok {
+				tsdbHealth.CircuitBreaker = breaker.BreakerState()
+			}
+			tsdbsHealth[i] = tsdbHealth
+		}(i, b)
+	}
+	wg.Wait()
+	for _, tsdbHealth := range tsdbsHealth {
+		if tsdbHealth.Status != "ok" {
+			statusCode = http.StatusInternalServerError
+		}
 	}
 
-	w.WriteHeader(statusCode)
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 
 	b, _ := json.MarshalIndent(HealthResponse{
 		Adapter: "ok",
-		Tsdb: TsdbHealthResponse{
-			Name:   h.adapter.Name(),
-			Status: status,
-		},
+		Tsdbs:   tsdbsHealth,
 	}, "", "\t")
 	w.Write(b)
 }
@@ -98,7 +156,12 @@ func (h adapterHandler) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := h.adapter.Read(&req)
+	if acceptsStreamedChunks(req.AcceptedResponseTypes) {
+		h.streamRead(r.Context(), w, &req)
+		return
+	}
+
+	resp, err := h.federatedRead(r.Context(), &req)
 	if err != nil {
 		entry := log.WithField("query", req)
 		entry.Warn("Error executing query: " + err.Error())
@@ -122,6 +185,55 @@ func (h adapterHandler) read(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// streamRead answers with series encoded as xor chunks, queries are read one by one and each series
+// is sent in its own frames as soon as its query is read. When the only backend read can send series
+// one by one, they are encoded as they are received so that only their chunks are kept until the query
+// ends, prometheus expects series sorted by labels. Other backends are read with federatedRead.
+func (h adapterHandler) streamRead(ctx context.Context, w http.ResponseWriter, req *prompb.ReadRequest) {
+	reader := h.seriesReader()
+	var chunkedWriter *chunkedWriter
+	for i, q := range req.Queries {
+		var series []*prompb.ChunkedSeries
+		var err error
+		if reader != nil {
+			series, err = h.readSeries(ctx, reader, q)
+		} else {
+			series, err = h.federatedReadSeries(ctx, q)
+		}
+		if err != nil {
+			log.WithField("query", q).Warn("Error executing query: " + err.Error())
+			if chunkedWriter == nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// response is already started with a 200, connection is cut before the end of the chunked body
+			// so that prometheus gets an unexpected EOF instead of results of the previous queries only
+			panic(http.ErrAbortHandler)
+		}
+		if chunkedWriter == nil {
+			w.Header().Set("Content-Type", streamedChunksContentType)
+			chunkedWriter = newChunkedWriter(w)
+		}
+		err = chunkedWriter.writeSeries(int64(i), series)
+		if err != nil {
+			log.Error("Error when streaming read response: " + err.Error())
+			return
+		}
+	}
+	if chunkedWriter == nil {
+		w.Header().Set("Content-Type", streamedChunksContentType)
+	}
+}
+
+func acceptsStreamedChunks(types []prompb.ReadRequest_ResponseType) bool {
+	for _, t := range types {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return true
+		}
+	}
+	return false
+}
+
 func (h adapterHandler) write(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -129,7 +241,7 @@ func (h adapterHandler) write(w http.ResponseWriter, r *http.Request) {
 	rmtIp := remoteIp(r)
 	entry := log.WithField("content_length", r.ContentLength).
 		WithField("ip", rmtIp)
-	entry.Debug("Sending data to kairos ...")
+	entry.Debug("Sending data to tsdb ...")
 
 	compressed, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -138,56 +250,162 @@ func (h adapterHandler) write(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	message, err := writeProto(r.Header.Get("Content-Type"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		log.Error("Error when decoding data:" + err.Error())
 		return
 	}
-
-	var req prompb.WriteRequest
-	err = proto.Unmarshal(reqBuf, &req)
+	var req *prompb.WriteRequest
+	if message == writeV2Proto {
+		req, err = decodeWriteV2(compressed)
+		// converted request is encoded again for queues
+		compressed = nil
+	} else {
+		req, err = decodeWriteRequest(compressed)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Error("Error when unmarshalling decoded data:" + err.Error())
+		log.Error("Error when decoding data:" + err.Error())
 		return
 	}
-	samples := protoToSamples(&req)
 
-	// Get faster as possible by creating worker pool to send data through adapter
-	jobsSample := make(chan *model.Sample, 100)
-	var wg sync.WaitGroup
-	wg.Add(h.workers)
-	for w := 1; w <= h.workers; w++ {
-		go func() {
-			defer wg.Done()
-			h.writeWorker(w, jobsSample)
-		}()
-	}
-
-	for _, s := range samples {
-		entry.WithField("sample_ts", s.Timestamp).WithField("value", s.Value).
-			Debugf("Sending sample with labels: %s", s.Metric.String())
-		jobsSample <- s
+	if !h.writeRequest(w, entry, req, compressed) {
+		return
 	}
-	close(jobsSample)
-	wg.Wait()
 
+	h.setWrittenHeaders(w, req)
 	entry.Debugf(
-		"Finished sending data to kairos in %s .",
+		"Finished sending data to tsdb in %s .",
 		time.Since(start).String(),
 	)
 }
-func (h adapterHandler) writeWorker(id int, jobsSample <-chan *model.Sample) {
-	entry := log.WithField("id", id)
-	entry.Debug("Starting write worker...")
-	for sample := range jobsSample {
-		err := h.adapter.Write(sample)
+
+// writeRequest sends samples of a write request to all backends, the first one is written right away unless
+// it has a queue and the other ones always have a queue. Compressed request is stored as is
+// by backends having a queue, it is encoded from request when nil or when metric names get tenant prefix.
+// It answers with an error and returns false when a backend failed or tenant rate limit is exceeded.
+func (h adapterHandler) writeRequest(w http.ResponseWriter, entry *log.Entry, req *prompb.WriteRequest, compressed []byte) bool {
+	if h.tenant != "" {
+		entry = entry.WithField("tenant", h.tenant)
+	}
+	h.countDropped(entry, req)
+	if h.writeConfig.Metadata == writePolicyStore {
+		h.metadata.store(req.Metadata)
+	}
+	if h.metricPrefix != "" {
+		prefixMetricNames(req, h.metricPrefix)
+		compressed = nil
+	}
+	samples := protoToSamples(req, h.writeConfig)
+	samplesReceived.Add(float64(len(samples)))
+	if h.limiter != nil {
+		if ok, wait := h.limiter.allow(len(samples)); !ok {
+			samplesRateLimited.WithLabelValues(h.tenant).Add(float64(len(samples)))
+			entry.Warnf("Tenant rate limit exceeded, refusing %d samples", len(samples))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("rate limit exceeded for tenant %s", h.tenant), http.StatusTooManyRequests)
+			return false
+		}
+	}
+	if compressed == nil {
+		var err error
+		compressed, err = h.queuePayload(req)
 		if err != nil {
-			log.Error("Error when sending one sample to kairos, skipping the sample:" + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			entry.Error("Error when encoding data:" + err.Error())
+			return false
+		}
+	}
+	results := make([]*writeResult, len(h.backends))
+	var wg sync.WaitGroup
+	for i, b := range h.backends {
+		wg.Add(1)
+		go func(i int, b *BackendWriter) {
+			defer wg.Done()
+			results[i] = b.write(entry, compressed, samples)
+		}(i, b)
+	}
+	wg.Wait()
+
+	// prometheus retries the whole request if the first backend or a queue can recover
+	var failures []string
+	statusCode := http.StatusOK
+	for i, result := range results {
+		if result.failed == 0 {
+			continue
+		}
+		failure := fmt.Sprintf(
+			"%s: %d/%d samples failed: %s",
+			h.backends[i].Name(), result.failed, len(samples), result.err.Error(),
+		)
+		failures = append(failures, failure)
+		if statusCode != http.StatusInternalServerError {
+			statusCode = result.statusCode()
 		}
 	}
-	entry.Debug("Finished write worker.")
+	if len(failures) > 0 {
+		entry.WithField("status_code", statusCode).Error(
+			"Samples could not be sent to tsdb: " + strings.Join(failures, "; "),
+		)
+		http.Error(w, strings.Join(failures, "\n"), statusCode)
+		return false
+	}
+	return true
+}
+
+// decodeWriteV2 decodes a snappy encoded remote write 2.0 request and converts it to a 1.0 one
+func decodeWriteV2(compressed []byte) (*prompb.WriteRequest, error) {
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return decodeWriteV2Request(reqBuf)
+}
+
+// queuePayload encodes a request as stored by queues,
+// nothing is encoded when no backend has a queue
+func (h adapterHandler) queuePayload(req *prompb.WriteRequest) ([]byte, error) {
+	for _, b := range h.backends {
+		if b.queue != nil {
+			return encodeWriteRequest(req)
+		}
+	}
+	return nil, nil
+}
+
+// setWrittenHeaders tells remote write 2.0 senders how much data were written,
+// exemplars and histograms dropped by write policy are not counted
+func (h adapterHandler) setWrittenHeaders(w http.ResponseWriter, req *prompb.WriteRequest) {
+	var exemplars, histograms int
+	for _, ts := range req.Timeseries {
+		exemplars += len(ts.Exemplars)
+		histograms += len(ts.Histograms)
+	}
+	if h.writeConfig.Exemplars != writePolicyStore {
+		exemplars = 0
+	}
+	if h.writeConfig.Histograms != writePolicyStore {
+		histograms = 0
+	}
+	w.Header().Set(samplesWrittenHeader, strconv.Itoa(countSamples(req)))
+	w.Header().Set(histogramsWrittenHeader, strconv.Itoa(histograms))
+	w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(exemplars))
+}
+
+// countDropped accounts exemplars, histograms and metadata which write policy drops
+func (h adapterHandler) countDropped(entry *log.Entry, req *prompb.WriteRequest) {
+	exemplars, histograms, metadata := h.writeConfig.countDropped(req)
+	if exemplars+histograms+metadata == 0 {
+		return
+	}
+	writeDropped.WithLabelValues("exemplar").Add(float64(exemplars))
+	writeDropped.WithLabelValues("histogram").Add(float64(histograms))
+	writeDropped.WithLabelValues("metadata").Add(float64(metadata))
+	entry.WithField("exemplars", exemplars).
+		WithField("histograms", histograms).
+		WithField("metadata", metadata).
+		Debug("Dropping data according to write policy")
 }
 
 func remoteIp(r *http.Request) string {
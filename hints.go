@@ -0,0 +1,92 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/ArthurHlt/go-kairosdb/builder"
+	"github.com/ArthurHlt/go-kairosdb/builder/aggregator"
+	"github.com/ArthurHlt/go-kairosdb/builder/utils"
+	"github.com/prometheus/prometheus/prompb"
+	"time"
+)
+
+// minHintsSampling avoids asking kairos to aggregate over ranges likely smaller than scrape interval
+const minHintsSampling = 10 * time.Second
+
+// hintsAggregators are kairos aggregators giving to a promql range function the same result
+// on aggregated points as on raw samples: the function must only depend on a value per sub range.
+// avg_over_time, count_over_time, rate and others depend on every sample and are not pushed down.
+var hintsAggregators = map[string]string{
+	"max_over_time":     "max",
+	"min_over_time":     "min",
+	"sum_over_time":     "sum",
+	"last_over_time":    "last",
+	"present_over_time": "last",
+}
+
+// kairosSampling describes the ranges of a pushed down aggregation, ranges are [start + k*size, start + (k+1)*size)
+type kairosSampling struct {
+	aggregator string
+	start      int64
+	size       int64
+}
+
+// newKairosSampling maps read hints onto a kairos aggregation, it returns nil when data must be read raw.
+// Functions of a query are evaluated at StartMs+RangeMs+k*StepMs over left-open windows of RangeMs, ranges of
+// gcd(StepMs, RangeMs) ending on evaluation timestamps split every window exactly. Hints don't tell apart
+// a subquery, which is evaluated at multiples of StepMs, so both must give the same timestamps.
+func newKairosSampling(hints *prompb.ReadHints) *kairosSampling {
+	if hints == nil || hints.RangeMs <= 0 {
+		return nil
+	}
+	if hints.StepMs > 0 && (hints.StartMs+hints.RangeMs)%hints.StepMs != 0 {
+		return nil
+	}
+	name, ok := hintsAggregators[hints.Func]
+	if !ok {
+		return nil
+	}
+	size := gcd(hints.StepMs, hints.RangeMs)
+	if size < int64(minHintsSampling/time.Millisecond) || int64(int(size)) != size {
+		return nil
+	}
+	return &kairosSampling{
+		aggregator: name,
+		start:      hints.StartMs + 1 - size,
+		size:       size,
+	}
+}
+
+func (s kairosSampling) Aggregator() builder.Aggregator {
+	return aggregator.NewSamplingAggregator(s.aggregator, int(s.size), utils.MILLISECONDS).
+		SetStartTimeAlignment(s.start)
+}
+
+// timestamp gives to an aggregated point the end of its range which is an evaluation timestamp,
+// kairos sets it to the start of the range
+func (s kairosSampling) timestamp(t int64) int64 {
+	offset := (t - s.start) % s.size
+	if offset < 0 {
+		offset += s.size
+	}
+	return t - offset + s.size - 1
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
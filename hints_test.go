@@ -0,0 +1,70 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"testing"
+)
+
+func TestNewKairosSampling(t *testing.T) {
+	// 2024-01-01T10:00:00Z
+	const hour = int64(1704103200000)
+	tests := []struct {
+		name  string
+		hints *prompb.ReadHints
+		want  *kairosSampling
+	}{
+		{
+			name:  "range query aligned on step",
+			hints: &prompb.ReadHints{Func: "max_over_time", StartMs: hour - 300000, EndMs: hour + 3600000, StepMs: 60000, RangeMs: 300000},
+			want:  &kairosSampling{aggregator: "max", start: hour - 300000 + 1 - 60000, size: 60000},
+		},
+		{
+			name:  "instant query",
+			hints: &prompb.ReadHints{Func: "sum_over_time", StartMs: hour + 30000 - 300000, EndMs: hour + 30000, RangeMs: 300000},
+			want:  &kairosSampling{aggregator: "sum", start: hour + 30000 - 300000 + 1 - 300000, size: 300000},
+		},
+		{
+			// max_over_time(max_over_time(x[5m])[1h:1m]) at 10:00:30 is evaluated at 09:01:00, 09:02:00 ...
+			name:  "subquery of an instant query not aligned on its step",
+			hints: &prompb.ReadHints{Func: "max_over_time", StartMs: hour + 30000 - 3600000 - 300000, EndMs: hour + 30000, StepMs: 60000, RangeMs: 300000},
+		},
+		{
+			name:  "range query not aligned on step",
+			hints: &prompb.ReadHints{Func: "max_over_time", StartMs: hour + 15000 - 300000, EndMs: hour + 3600000, StepMs: 60000, RangeMs: 300000},
+		},
+		{
+			name:  "function depending on every sample",
+			hints: &prompb.ReadHints{Func: "rate", StartMs: hour - 300000, EndMs: hour + 3600000, StepMs: 60000, RangeMs: 300000},
+		},
+		{
+			name:  "ranges smaller than scrape interval",
+			hints: &prompb.ReadHints{Func: "max_over_time", StartMs: hour - 300000, EndMs: hour + 3600000, StepMs: 5000, RangeMs: 300000},
+		},
+	}
+	for _, test := range tests {
+		got := newKairosSampling(test.hints)
+		if got == nil || test.want == nil {
+			if got != test.want {
+				t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+			}
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, *test.want)
+		}
+	}
+}
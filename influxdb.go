@@ -0,0 +1,458 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("influxdb", func() interface{} { return &InfluxConfig{} }, newInfluxBackend)
+}
+
+type InfluxConfig struct {
+	Url             string                 `yaml:"url"`
+	Database        string                 `yaml:"database"`
+	RetentionPolicy string                 `yaml:"retention_policy"`
+	Username        string                 `yaml:"username"`
+	Password        string                 `yaml:"password"`
+	SkipInsecure    bool                   `yaml:"skip_insecure"`
+	XXX             map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *InfluxConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain InfluxConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("Config backend influxdb: url must be set")
+	}
+	if c.Database == "" {
+		return fmt.Errorf("Config backend influxdb: database must be set")
+	}
+	c.Url = strings.TrimSuffix(c.Url, "/")
+	return checkBackendOverflow(c.XXX, "Config backend influxdb")
+}
+
+func newInfluxBackend(config interface{}, opts BackendOptions) (Adapter, error) {
+	c := config.(*InfluxConfig)
+	client := createClient(opts.Name, c.SkipInsecure, opts.Workers)
+	return NewInfluxAdapter(*c, client, opts.BatchSize), nil
+}
+
+// InfluxAdapter writes samples to InfluxDB 1.x with line protocol
+// in measurements named after metric name with a value field.
+type InfluxAdapter struct {
+	config    InfluxConfig
+	client    *http.Client
+	batchSize int
+}
+
+type influxQueryResponse struct {
+	Results []influxResult `json:"results"`
+	Err     string         `json:"error"`
+}
+
+type influxResult struct {
+	Series []influxSeries `json:"series"`
+	Err    string         `json:"error"`
+}
+
+type influxSeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+func NewInfluxAdapter(config InfluxConfig, client *http.Client, batchSize int) *InfluxAdapter {
+	return &InfluxAdapter{
+		config:    config,
+		client:    client,
+		batchSize: batchSize,
+	}
+}
+
+func (a InfluxAdapter) Write(samples model.Samples) (int, error) {
+	var buf bytes.Buffer
+	nbPoints := 0
+	written := 0
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Debug("Skipping sample, influxdb doesn't support NaN or infinite value.")
+			samplesDropped.WithLabelValues("invalid_value").Inc()
+			continue
+		}
+		a.writeLine(&buf, s)
+		nbPoints++
+
+		if nbPoints < a.batchSize {
+			continue
+		}
+		err := a.postLines(&buf)
+		if err != nil {
+			return written, err
+		}
+		written += nbPoints
+		buf.Reset()
+		nbPoints = 0
+	}
+	if nbPoints == 0 {
+		return written, nil
+	}
+	if err := a.postLines(&buf); err != nil {
+		return written, err
+	}
+	return written + nbPoints, nil
+}
+
+// writeLine writes a sample in line protocol with millisecond precision
+func (InfluxAdapter) writeLine(buf *bytes.Buffer, s *model.Sample) {
+	name := string(s.Metric[model.MetricNameLabel])
+	if name == "" {
+		name = "none"
+	}
+	buf.WriteString(influxMeasurementEscaper.Replace(name))
+
+	names := make([]string, 0, len(s.Metric))
+	for name, value := range s.Metric {
+		if name == model.MetricNameLabel || value == "" {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	// influxdb performs better when tags are sorted
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteByte(',')
+		buf.WriteString(influxTagEscaper.Replace(name))
+		buf.WriteByte('=')
+		buf.WriteString(influxTagEscaper.Replace(string(s.Metric[model.LabelName(name)])))
+	}
+
+	buf.WriteString(" value=")
+	buf.WriteString(strconv.FormatFloat(float64(s.Value), 'f', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(int64(s.Timestamp), 10))
+	buf.WriteByte('\n')
+}
+
+func (a InfluxAdapter) postLines(buf *bytes.Buffer) error {
+	params := url.Values{}
+	params.Set("db", a.config.Database)
+	params.Set("precision", "ms")
+	if a.config.RetentionPolicy != "" {
+		params.Set("rp", a.config.RetentionPolicy)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.config.Url+"/write?"+params.Encode(), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := a.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (a InfluxAdapter) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	for _, q := range req.Queries {
+		command, nameFilter, err := a.buildCommand(q)
+		if err != nil {
+			return nil, err
+		}
+
+		series, err := a.query(ctx, command)
+		if err != nil {
+			return nil, err
+		}
+
+		err = a.mergeResult(labelsToSeries, series, nameFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{Timeseries: make([]*prompb.TimeSeries, 0, len(labelsToSeries))},
+		},
+	}
+	for _, ts := range labelsToSeries {
+		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	}
+	return &resp, nil
+}
+
+// buildCommand translates a query into influxQL, influxdb can't select measurements
+// which don't match a name so returned filter must be applied on measurements names.
+func (a InfluxAdapter) buildCommand(q *prompb.Query) (string, func(string) bool, error) {
+	matchers := make([]string, 0, len(q.Matchers))
+	from := "FROM " + a.measurement("/.+/")
+	// every matcher on name must pass, only the first positive one can select measurements in FROM
+	var nameFilters []func(string) bool
+	nameFilter := func(name string) bool {
+		for _, filter := range nameFilters {
+			if !filter(name) {
+				return false
+			}
+		}
+		return true
+	}
+	fromSet := false
+	for _, m := range q.Matchers {
+		if m.Name == model.MetricNameLabel {
+			value := m.Value
+			switch m.Type {
+			case prompb.LabelMatcher_EQ:
+				if !fromSet {
+					from = "FROM " + a.measurement(strconv.Quote(value))
+				}
+				nameFilters = append(nameFilters, func(name string) bool { return name == value })
+			case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+				reg, err := regexp.Compile("^(?:" + value + ")$")
+				if err != nil {
+					return "", nil, err
+				}
+				if m.Type == prompb.LabelMatcher_NRE {
+					nameFilters = append(nameFilters, func(name string) bool { return !reg.MatchString(name) })
+					break
+				}
+				if !fromSet {
+					from = "FROM " + a.measurement(fmt.Sprintf("/^(?:%s)$/", escapeSlashes(value)))
+				}
+				nameFilters = append(nameFilters, reg.MatchString)
+			case prompb.LabelMatcher_NEQ:
+				nameFilters = append(nameFilters, func(name string) bool { return name != value })
+			default:
+				return "", nil, fmt.Errorf("unknown match type %v", m.Type)
+			}
+			fromSet = fromSet || m.Type == prompb.LabelMatcher_EQ || m.Type == prompb.LabelMatcher_RE
+			continue
+		}
+
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			matchers = append(matchers, fmt.Sprintf("%q = '%s'", m.Name, escapeSingleQuotes(m.Value)))
+		case prompb.LabelMatcher_NEQ:
+			matchers = append(matchers, fmt.Sprintf("%q != '%s'", m.Name, escapeSingleQuotes(m.Value)))
+		case prompb.LabelMatcher_RE:
+			matchers = append(matchers, fmt.Sprintf("%q =~ /^(?:%s)$/", m.Name, escapeSlashes(m.Value)))
+		case prompb.LabelMatcher_NRE:
+			matchers = append(matchers, fmt.Sprintf("%q !~ /^(?:%s)$/", m.Name, escapeSlashes(m.Value)))
+		default:
+			return "", nil, fmt.Errorf("unknown match type %v", m.Type)
+		}
+	}
+	matchers = append(matchers, fmt.Sprintf("time >= %dms", q.StartTimestampMs))
+	matchers = append(matchers, fmt.Sprintf("time <= %dms", q.EndTimestampMs))
+
+	command := fmt.Sprintf("SELECT value %s WHERE %s GROUP BY *", from, strings.Join(matchers, " AND "))
+	return command, nameFilter, nil
+}
+
+func (a InfluxAdapter) measurement(name string) string {
+	if a.config.RetentionPolicy == "" {
+		return name
+	}
+	return strconv.Quote(a.config.RetentionPolicy) + "." + name
+}
+
+func (a InfluxAdapter) query(ctx context.Context, command string) ([]influxSeries, error) {
+	params := url.Values{}
+	params.Set("db", a.config.Database)
+	params.Set("epoch", "ms")
+	params.Set("q", command)
+	req, err := http.NewRequest(http.MethodPost, a.config.Url+"/query", strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var queryResp influxQueryResponse
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	err = dec.Decode(&queryResp)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	if queryResp.Err != "" {
+		return nil, errors.New(queryResp.Err)
+	}
+	series := make([]influxSeries, 0)
+	for _, result := range queryResp.Results {
+		if result.Err != "" {
+			return nil, errors.New(result.Err)
+		}
+		series = append(series, result.Series...)
+	}
+	return series, nil
+}
+
+func (a InfluxAdapter) mergeResult(labelsToSeries map[string]*prompb.TimeSeries, series []influxSeries, nameFilter func(string) bool) error {
+	for _, s := range series {
+		if !nameFilter(s.Name) {
+			continue
+		}
+		labels := a.tagsToLabelPairs(s.Name, s.Tags)
+		k := labelsKey(labels)
+		ts, ok := labelsToSeries[k]
+		if !ok {
+			ts = &prompb.TimeSeries{
+				Labels: labels,
+			}
+			labelsToSeries[k] = ts
+		}
+
+		samples, err := a.valuesToSamples(s.Values)
+		if err != nil {
+			return err
+		}
+		ts.Samples = mergeSamples(ts.Samples, samples)
+	}
+	return nil
+}
+
+func (InfluxAdapter) tagsToLabelPairs(name string, tags map[string]string) []prompb.Label {
+	pairs := make([]prompb.Label, 0, len(tags)+1)
+	for k, v := range tags {
+		if v == "" {
+			// If we select metrics with different sets of labels names,
+			// InfluxDB returns *all* possible tag names on all returned
+			// series, with empty tag values on series where they don't
+			// apply. In Prometheus, an empty label value is equivalent
+			// to a non-existent label, so we just skip empty ones here
+			// to make the result correct.
+			continue
+		}
+		pairs = append(pairs, prompb.Label{
+			Name:  k,
+			Value: v,
+		})
+	}
+	pairs = append(pairs, prompb.Label{
+		Name:  model.MetricNameLabel,
+		Value: name,
+	})
+	return pairs
+}
+
+func (InfluxAdapter) valuesToSamples(values [][]interface{}) ([]prompb.Sample, error) {
+	samples := make([]prompb.Sample, 0, len(values))
+	for _, v := range values {
+		if len(v) != 2 {
+			return nil, fmt.Errorf("bad sample tuple length, expected [<timestamp>, <value>], got %v", v)
+		}
+
+		jsonTimestamp, ok := v[0].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("bad timestamp: %v", v[0])
+		}
+		jsonValue, ok := v[1].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("bad sample value: %v", v[1])
+		}
+
+		timestamp, err := jsonTimestamp.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert sample timestamp to int64: %v", err)
+		}
+		value, err := jsonValue.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert sample value to float64: %v", err)
+		}
+
+		samples = append(samples, prompb.Sample{
+			Timestamp: timestamp,
+			Value:     value,
+		})
+	}
+	return samples, nil
+}
+
+func (a InfluxAdapter) Healthy() bool {
+	req, err := http.NewRequest(http.MethodGet, a.config.Url+"/ping", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := a.do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
+
+func (a InfluxAdapter) Name() string {
+	return "influxdb"
+}
+
+// do sends request to influxdb and turns error status codes into errors
+func (a InfluxAdapter) do(req *http.Request) (*http.Response, error) {
+	if a.config.Username != "" {
+		req.SetBasicAuth(a.config.Username, a.config.Password)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var errResp struct {
+		Err string `json:"error"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(body, &errResp) != nil || errResp.Err == "" {
+		errResp.Err = strings.TrimSpace(string(body))
+	}
+	err = fmt.Errorf("influxdb responded with status code %d: %s", resp.StatusCode, errResp.Err)
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, NewRecoverableError(err)
+	}
+	return nil, err
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
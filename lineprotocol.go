@@ -0,0 +1,250 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lineProtocolPrecisions gives timestamp unit of precision parameter in influxdb v1 and v2 apis
+var lineProtocolPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// influxWrite receives points in influxdb line protocol as sent to /write of influxdb v1 or /api/v2/write of v2,
+// each field of a point is a sample named after measurement and field with tags as labels.
+func (h adapterHandler) influxWrite(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	start := time.Now()
+	entry := log.WithField("content_length", r.ContentLength).
+		WithField("ip", remoteIp(r))
+	entry.Debug("Sending influx points to tsdb ...")
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Error("Error when decoding data:" + err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error("Error when getting data from response:" + err.Error())
+		return
+	}
+
+	precision, ok := lineProtocolPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		http.Error(w, "invalid precision "+r.URL.Query().Get("precision"), http.StatusBadRequest)
+		log.Error("Error when decoding data: invalid precision " + r.URL.Query().Get("precision"))
+		return
+	}
+	req, stringFields, err := parseLineProtocol(data, precision, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error("Error when decoding data:" + err.Error())
+		return
+	}
+	if stringFields > 0 {
+		writeDropped.WithLabelValues("influx_string_field").Add(float64(stringFields))
+		entry.WithField("string_fields", stringFields).Debug("Dropping string fields which can't be samples")
+	}
+
+	if !h.writeRequest(w, entry, req, nil) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	entry.Debugf(
+		"Finished sending influx points to tsdb in %s .",
+		time.Since(start).String(),
+	)
+}
+
+// ping answers influxdb clients checking the server is up
+func (h adapterHandler) ping(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseLineProtocol converts influxdb points to a write request, a point without timestamp is set at now.
+// String fields can't be stored as samples and are only counted.
+func parseLineProtocol(data []byte, precision time.Duration, now time.Time) (*prompb.WriteRequest, int, error) {
+	req := &prompb.WriteRequest{}
+	stringFields := 0
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		nb, err := parseLinePoint(req, string(line), precision, now)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %s", i+1, err.Error())
+		}
+		stringFields += nb
+	}
+	return req, stringFields, nil
+}
+
+func parseLinePoint(req *prompb.WriteRequest, line string, precision time.Duration, now time.Time) (int, error) {
+	sections := splitLineProtocol(line, ' ', false, 1)
+	if len(sections) < 2 {
+		return 0, fmt.Errorf("missing fields")
+	}
+	fields := splitLineProtocol(sections[1], ' ', true, 1)
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	if len(fields) == 2 {
+		ts, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %s", fields[1])
+		}
+		timestamp = ts * int64(precision) / int64(time.Millisecond)
+	}
+
+	tags := splitLineProtocol(sections[0], ',', false, -1)
+	measurement := unescapeLineProtocol(tags[0])
+	if measurement == "" {
+		return 0, fmt.Errorf("missing measurement")
+	}
+	labels := make([]prompb.Label, 0, len(tags))
+	for _, tag := range tags[1:] {
+		kv := splitLineProtocol(tag, '=', false, 1)
+		if len(kv) != 2 || kv[0] == "" {
+			return 0, fmt.Errorf("invalid tag %s", tag)
+		}
+		labels = append(labels, prompb.Label{
+			Name:  sanitizeName(unescapeLineProtocol(kv[0]), false),
+			Value: unescapeLineProtocol(kv[1]),
+		})
+	}
+
+	stringFields := 0
+	for _, field := range splitLineProtocol(fields[0], ',', true, -1) {
+		kv := splitLineProtocol(field, '=', true, 1)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return 0, fmt.Errorf("invalid field %s", field)
+		}
+		if kv[1][0] == '"' {
+			stringFields++
+			continue
+		}
+		value, err := parseLineFieldValue(kv[1])
+		if err != nil {
+			return 0, err
+		}
+		name := sanitizeName(measurement+"_"+unescapeLineProtocol(kv[0]), true)
+		seriesLabels := make([]prompb.Label, 0, len(labels)+1)
+		seriesLabels = append(seriesLabels, prompb.Label{Name: model.MetricNameLabel, Value: name})
+		seriesLabels = append(seriesLabels, labels...)
+		sort.Slice(seriesLabels, func(i, j int) bool {
+			return seriesLabels[i].Name < seriesLabels[j].Name
+		})
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  seriesLabels,
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+	return stringFields, nil
+}
+
+// parseLineFieldValue parses float, integer (suffixed by i), unsigned (suffixed by u) and boolean fields
+func parseLineFieldValue(value string) (float64, error) {
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	var err error
+	var v float64
+	switch value[len(value)-1] {
+	case 'i':
+		var i int64
+		i, err = strconv.ParseInt(value[:len(value)-1], 10, 64)
+		v = float64(i)
+	case 'u':
+		var u uint64
+		u, err = strconv.ParseUint(value[:len(value)-1], 10, 64)
+		v = float64(u)
+	default:
+		v, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid field value %s", value)
+	}
+	return v, nil
+}
+
+// splitLineProtocol splits s on sep not escaped by a backslash, nor inside double quotes when quoted is set,
+// at most max times when max is positive
+func splitLineProtocol(s string, sep byte, quoted bool, max int) []string {
+	var parts []string
+	inQuotes := false
+	begin := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			if max >= 0 && len(parts) == max {
+				return append(parts, s[begin:])
+			}
+			parts = append(parts, s[begin:i])
+			begin = i + 1
+		}
+	}
+	return append(parts, s[begin:])
+}
+
+// unescapeLineProtocol removes backslashes escaping commas, equal signs, spaces, quotes and backslashes
+func unescapeLineProtocol(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/prometheus/prompb"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetadataResponse follows format of prometheus /api/v1/metadata
+type MetadataResponse struct {
+	Status string                      `json:"status"`
+	Data   map[string][]MetricMetadata `json:"data"`
+}
+
+type MetricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// metadataStore keeps last metadata received for each metric family,
+// tsdbs have no place for them so they are kept in memory and served as prometheus does
+type metadataStore struct {
+	mu       sync.RWMutex
+	metadata map[string]MetricMetadata
+}
+
+func newMetadataStore() *metadataStore {
+	return &metadataStore{metadata: make(map[string]MetricMetadata)}
+}
+
+func (s *metadataStore) store(metadata []prompb.MetricMetadata) {
+	if len(metadata) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range metadata {
+		s.metadata[m.MetricFamilyName] = MetricMetadata{
+			Type: strings.ToLower(m.Type.String()),
+			Help: m.Help,
+			Unit: m.Unit,
+		}
+	}
+}
+
+// ServeHTTP answers metadata of all metrics or of the one given in metric parameter,
+// limit parameter caps the number of metrics returned
+func (s *metadataStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := -1
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	metric := r.URL.Query().Get("metric")
+
+	s.mu.RLock()
+	names := make([]string, 0, len(s.metadata))
+	for name := range s.metadata {
+		if metric != "" && name != metric {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if limit >= 0 && len(names) > limit {
+		names = names[:limit]
+	}
+	data := make(map[string][]MetricMetadata, len(names))
+	for _, name := range names {
+		data[name] = []MetricMetadata{s.metadata[name]}
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(MetadataResponse{
+		Status: "success",
+		Data:   data,
+	})
+	w.Write(b)
+}
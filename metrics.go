@@ -0,0 +1,228 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "prometheus_fast_remote"
+
+var (
+	samplesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_received_total",
+		Help:      "Total number of samples received on write endpoint.",
+	})
+	samplesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_written_total",
+		Help:      "Total number of samples successfully sent to tsdb.",
+	}, []string{"backend"})
+	samplesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_failed_total",
+		Help:      "Total number of samples which could not be sent to tsdb, reason is recoverable when tsdb was failing or rejected when tsdb refused them.",
+	}, []string{"backend", "reason"})
+	samplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_dropped_total",
+		Help:      "Total number of samples dropped by the adapter.",
+	}, []string{"reason"})
+	writeDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_dropped_total",
+		Help:      "Total number of exemplars, histograms and metadata received on write endpoint and dropped by write policy.",
+	}, []string{"type"})
+	samplesRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_rate_limited_total",
+		Help:      "Total number of samples refused because tenant rate limit was exceeded.",
+	}, []string{"tenant"})
+	authFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failed_total",
+		Help:      "Total number of requests refused because caller is unauthenticated or forbidden.",
+	}, []string{"reason"})
+	readsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reads_failed_total",
+		Help:      "Total number of read requests which failed or timed out on a backend.",
+	}, []string{"backend"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests received on read and write endpoints.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "code", "method"})
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Duration of http calls made to tsdb by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "endpoint", "code"})
+	writeWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_workers",
+		Help:      "Number of write workers started for each write request.",
+	}, []string{"backend"})
+	writeWorkersBusy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_workers_busy",
+		Help:      "Number of write workers currently sending a batch of samples to tsdb.",
+	}, []string{"backend"})
+	writeBatchesPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_batches_pending",
+		Help:      "Number of batches of samples waiting for a write worker.",
+	}, []string{"backend"})
+	queueDroppedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_dropped_bytes_total",
+		Help:      "Total number of bytes dropped from write queue because of queue limits or corruption.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		samplesReceived,
+		samplesWritten,
+		samplesFailed,
+		samplesDropped,
+		writeDropped,
+		samplesRateLimited,
+		authFailed,
+		readsFailed,
+		requestDuration,
+		backendRequestDuration,
+		writeWorkers,
+		writeWorkersBusy,
+		writeBatchesPending,
+		queueDroppedBytes,
+		queueMetrics,
+	)
+}
+
+// queueCollector exposes queue depth of backend writers, a writer of a reloaded config replaces the previous one
+type queueCollector struct {
+	mu       sync.Mutex
+	writers  map[string]*BackendWriter
+	size     *prometheus.Desc
+	segments *prometheus.Desc
+}
+
+var queueMetrics = &queueCollector{
+	writers: make(map[string]*BackendWriter),
+	size: prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "queue_size_bytes"),
+		"Number of bytes stored in write queue segments.",
+		[]string{"backend"}, nil,
+	),
+	segments: prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "queue_segments"),
+		"Number of segments in write queue.",
+		[]string{"backend"}, nil,
+	),
+}
+
+func (c *queueCollector) set(b *BackendWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writers[b.name] = b
+}
+
+// remove forgets a writer unless it has been replaced meanwhile
+func (c *queueCollector) remove(b *BackendWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writers[b.name] == b {
+		delete(c.writers, b.name)
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.size
+	ch <- c.segments
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for backend, b := range c.writers {
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(b.queue.Size()), backend)
+		ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(b.queue.Segments()), backend)
+	}
+}
+
+// samplesLost gives the number of samples which failed to be sent to a tsdb or were dropped since start,
+// samples dropped for their NaN or infinite value are left out as no tsdb could take them
+func samplesLost() float64 {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		samplesFailed.Collect(metrics)
+		samplesDropped.Collect(metrics)
+		close(metrics)
+	}()
+	lost := 0.0
+	for m := range metrics {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		invalid := false
+		for _, l := range metric.GetLabel() {
+			invalid = invalid || l.GetName() == "reason" && l.GetValue() == "invalid_value"
+		}
+		if !invalid {
+			lost += metric.GetCounter().GetValue()
+		}
+	}
+	return lost
+}
+
+func instrumentHandler(name string, handler http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerDuration(
+		requestDuration.MustCurryWith(prometheus.Labels{"handler": name}),
+		handler,
+	)
+}
+
+// instrumentedTransport observes duration of calls made to a tsdb labelled by url path
+type instrumentedTransport struct {
+	backend string
+	next    http.RoundTripper
+}
+
+func instrumentTransport(backend string, next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{backend, next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	backendRequestDuration.WithLabelValues(t.backend, req.URL.Path, code).
+		Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,474 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterBackend("opentsdb", func() interface{} { return &OpenTSDBConfig{} }, newOpenTSDBBackend)
+}
+
+type OpenTSDBConfig struct {
+	Url          string                 `yaml:"url"`
+	SkipInsecure bool                   `yaml:"skip_insecure"`
+	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *OpenTSDBConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain OpenTSDBConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("Config backend opentsdb: url must be set")
+	}
+	c.Url = strings.TrimSuffix(c.Url, "/")
+	return checkBackendOverflow(c.XXX, "Config backend opentsdb")
+}
+
+func newOpenTSDBBackend(config interface{}, opts BackendOptions) (Adapter, error) {
+	c := config.(*OpenTSDBConfig)
+	client := createClient(opts.Name, c.SkipInsecure, opts.Workers)
+	return NewOpenTSDBAdapter(c.Url, client, opts.BatchSize), nil
+}
+
+// OpenTSDBAdapter writes samples through /api/put and reads them through /api/query.
+// Metric name and tags are made the same way than for kairosdb, only characters not allowed
+// by opentsdb in metric name and tag values are then escaped as _XX with XX the hex code
+// of the byte. Prometheus label names are always valid opentsdb tag keys.
+type OpenTSDBAdapter struct {
+	url       string
+	client    *http.Client
+	batchSize int
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type openTSDBQuery struct {
+	Start        int64              `json:"start"`
+	End          int64              `json:"end"`
+	MsResolution bool               `json:"msResolution"`
+	Queries      []openTSDBSubQuery `json:"queries"`
+}
+
+type openTSDBSubQuery struct {
+	Metric     string           `json:"metric"`
+	Aggregator string           `json:"aggregator"`
+	Filters    []openTSDBFilter `json:"filters,omitempty"`
+}
+
+type openTSDBFilter struct {
+	Type    string `json:"type"`
+	Tagk    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+type openTSDBResult struct {
+	Metric string             `json:"metric"`
+	Tags   map[string]string  `json:"tags"`
+	Dps    map[string]float64 `json:"dps"`
+}
+
+func NewOpenTSDBAdapter(url string, client *http.Client, batchSize int) *OpenTSDBAdapter {
+	return &OpenTSDBAdapter{
+		url:       url,
+		client:    client,
+		batchSize: batchSize,
+	}
+}
+
+func (a OpenTSDBAdapter) Write(samples model.Samples) (int, error) {
+	points := make([]openTSDBPoint, 0, a.batchSize)
+	written := 0
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Debug("Skipping sample, opentsdb doesn't support NaN or infinite value.")
+			samplesDropped.WithLabelValues("invalid_value").Inc()
+			continue
+		}
+		metricName, tags := metricToTags(s.Metric)
+		escapedTags := make(map[string]string, len(tags))
+		for k, v := range tags {
+			escapedTags[k] = openTSDBEscape(v)
+		}
+		points = append(points, openTSDBPoint{
+			Metric:    openTSDBEscape(metricName),
+			Timestamp: makeTimestamp(s.Timestamp),
+			Value:     v,
+			Tags:      escapedTags,
+		})
+
+		if len(points) < a.batchSize {
+			continue
+		}
+		err := a.put(points)
+		if err != nil {
+			return written, err
+		}
+		written += len(points)
+		points = points[:0]
+	}
+	if len(points) == 0 {
+		return written, nil
+	}
+	if err := a.put(points); err != nil {
+		return written, err
+	}
+	return written + len(points), nil
+}
+
+func (a OpenTSDBAdapter) put(points []openTSDBPoint) error {
+	b, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	resp, err := a.post(context.Background(), "/api/put?details", b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (a OpenTSDBAdapter) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	for _, q := range req.Queries {
+		matchers, err := newLabelMatchers(q.Matchers)
+		if err != nil {
+			return nil, err
+		}
+		query, err := a.buildQuery(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		if len(query.Queries) == 0 {
+			continue
+		}
+
+		results, err := a.query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range results {
+			labels := a.tagsToLabelPairs(r.Metric, r.Tags)
+			// matchers which can't be expressed as opentsdb filters are applied here
+			if !matchLabels(matchers, labels) {
+				continue
+			}
+			k := labelsKey(labels)
+			ts, ok := labelsToSeries[k]
+			if !ok {
+				ts = &prompb.TimeSeries{
+					Labels: labels,
+				}
+				labelsToSeries[k] = ts
+			}
+			samples, err := a.dpsToSamples(r.Dps)
+			if err != nil {
+				return nil, err
+			}
+			ts.Samples = mergeSamples(ts.Samples, samples)
+		}
+	}
+
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{Timeseries: make([]*prompb.TimeSeries, 0, len(labelsToSeries))},
+		},
+	}
+	for _, ts := range labelsToSeries {
+		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	}
+	return &resp, nil
+}
+
+func (a OpenTSDBAdapter) buildQuery(ctx context.Context, q *prompb.Query) (openTSDBQuery, error) {
+	query := openTSDBQuery{
+		Start:        q.StartTimestampMs,
+		End:          q.EndTimestampMs,
+		MsResolution: true,
+	}
+
+	metricNames := make([]string, 0)
+	filters := make([]openTSDBFilter, 0)
+	for _, m := range q.Matchers {
+		if m.Name == model.MetricNameLabel {
+			if m.Type == prompb.LabelMatcher_EQ {
+				metricNames = append(metricNames, openTSDBEscape(m.Value))
+				continue
+			}
+			names, err := a.metricNames(ctx, m)
+			if err != nil {
+				return query, err
+			}
+			metricNames = append(metricNames, names...)
+			continue
+		}
+
+		// an empty value matches series without the tag, it can only be checked on results
+		if m.Value == "" {
+			continue
+		}
+		filter := openTSDBFilter{
+			Tagk:    m.Name,
+			GroupBy: true,
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			filter.Type = "literal_or"
+			filter.Filter = openTSDBEscape(m.Value)
+		case prompb.LabelMatcher_RE:
+			// opentsdb applies regexp on escaped values, only a list of values can be sent as they can be escaped
+			values, ok := regexLiterals(m.Value)
+			if !ok {
+				continue
+			}
+			for i, v := range values {
+				values[i] = openTSDBEscape(v)
+			}
+			filter.Type = "literal_or"
+			filter.Filter = strings.Join(values, "|")
+		case prompb.LabelMatcher_NEQ, prompb.LabelMatcher_NRE:
+			// not_literal_or drops series without the tag which are kept by prometheus
+			continue
+		default:
+			return query, fmt.Errorf("unknown match type %v", m.Type)
+		}
+		filters = append(filters, filter)
+	}
+
+	for _, name := range metricNames {
+		query.Queries = append(query.Queries, openTSDBSubQuery{
+			Metric:     name,
+			Aggregator: "none",
+			Filters:    filters,
+		})
+	}
+	return query, nil
+}
+
+// metricNames gives escaped metric names known by opentsdb which match a matcher on metric name
+func (a OpenTSDBAdapter) metricNames(ctx context.Context, m *prompb.LabelMatcher) ([]string, error) {
+	matchers, err := newLabelMatchers([]*prompb.LabelMatcher{m})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.get(ctx, "/api/suggest?type=metrics&max="+strconv.Itoa(math.MaxInt32))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var allNames []string
+	err = json.NewDecoder(resp.Body).Decode(&allNames)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	names := make([]string, 0)
+	for _, name := range allNames {
+		if matchers[0].matches(openTSDBUnescape(name)) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (a OpenTSDBAdapter) query(ctx context.Context, query openTSDBQuery) ([]openTSDBResult, error) {
+	b, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.post(ctx, "/api/query", b)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such name for") {
+			// metric or tag doesn't exist in opentsdb
+			return []openTSDBResult{}, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var results []openTSDBResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	return results, nil
+}
+
+func (OpenTSDBAdapter) tagsToLabelPairs(name string, tags map[string]string) []prompb.Label {
+	pairs := make([]prompb.Label, 0, len(tags)+1)
+	for k, v := range tags {
+		pairs = append(pairs, prompb.Label{
+			Name:  k,
+			Value: openTSDBUnescape(v),
+		})
+	}
+	pairs = append(pairs, prompb.Label{
+		Name:  model.MetricNameLabel,
+		Value: openTSDBUnescape(name),
+	})
+	return pairs
+}
+
+func (OpenTSDBAdapter) dpsToSamples(dps map[string]float64) ([]prompb.Sample, error) {
+	samples := make([]prompb.Sample, 0, len(dps))
+	for ts, v := range dps {
+		timestamp, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp %s: %v", ts, err)
+		}
+		samples = append(samples, prompb.Sample{
+			Timestamp: timestamp,
+			Value:     v,
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	return samples, nil
+}
+
+func (a OpenTSDBAdapter) Healthy() bool {
+	resp, err := a.get(context.Background(), "/api/version")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (a OpenTSDBAdapter) Name() string {
+	return "opentsdb"
+}
+
+func (a OpenTSDBAdapter) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	return a.checkResponse(resp)
+}
+
+func (a OpenTSDBAdapter) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, a.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, NewRecoverableError(err)
+	}
+	return a.checkResponse(resp)
+}
+
+// checkResponse turns error status codes into errors
+func (OpenTSDBAdapter) checkResponse(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Errors []struct {
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &errResp) == nil {
+		if len(errResp.Errors) > 0 {
+			message = fmt.Sprintf("%d data points rejected, first error: %s", len(errResp.Errors), errResp.Errors[0].Error)
+		} else if errResp.Error.Message != "" {
+			message = errResp.Error.Message
+		}
+	}
+	err := fmt.Errorf("opentsdb responded with status code %d: %s", resp.StatusCode, message)
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, NewRecoverableError(err)
+	}
+	return nil, err
+}
+
+var openTSDBEscapeRegexp = regexp.MustCompile(`_[0-9A-F]{2}`)
+
+// openTSDBAllowed tells if opentsdb accepts a character in names and tags
+func openTSDBAllowed(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '-' || r == '_' || r == '.' || r == '/'
+}
+
+// openTSDBEscape keeps characters allowed by opentsdb and escapes other ones as _XX, an underscore which
+// would be read back as an escape because it is followed by two hex digits is escaped as well
+func openTSDBEscape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r != utf8.RuneError && openTSDBAllowed(r) && !openTSDBLooksEscaped(s[i:]) {
+			buf.WriteRune(r)
+		} else {
+			for _, b := range []byte(s[i : i+size]) {
+				fmt.Fprintf(&buf, "_%02X", b)
+			}
+		}
+		i += size
+	}
+	return buf.String()
+}
+
+// openTSDBLooksEscaped tells if s starts with _ followed by two upper case hex digits
+func openTSDBLooksEscaped(s string) bool {
+	isHex := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+	}
+	return len(s) >= 3 && s[0] == '_' && isHex(s[1]) && isHex(s[2])
+}
+
+// openTSDBUnescape decodes every _XX, written names never have one which is not an escape
+func openTSDBUnescape(s string) string {
+	return openTSDBEscapeRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		b, _ := strconv.ParseUint(m[1:], 16, 8)
+		return string([]byte{byte(b)})
+	})
+}
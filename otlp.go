@@ -0,0 +1,686 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// staleNaN marks a series as stale as prometheus does
+	staleNaN = 0x7ff0000000000002
+	// otlpNoRecordedValue is set in data point flags when the point has no value, e.g. when its series disappeared
+	otlpNoRecordedValue = uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)
+	// native histograms schemas are limited to -4..8, OTLP scale is greater for more precise histograms
+	minHistogramSchema = -4
+	maxHistogramSchema = 8
+)
+
+// OTLPConfig sets how OTLP metrics are converted to samples
+type OTLPConfig struct {
+	// PromoteResourceAttributes are resource attributes added to labels of all series of the resource,
+	// service.name and service.instance.id are always set as job and instance labels.
+	PromoteResourceAttributes []string               `yaml:"promote_resource_attributes"`
+	XXX                       map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *OTLPConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain OTLPConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return checkOverflow(c.XXX, "Config write otlp")
+}
+
+// otlpWrite receives OTLP/HTTP metrics in protobuf or JSON and sends them to backends as remote write samples,
+// data points which can't be converted are rejected and reported in a partial success response.
+func (h adapterHandler) otlpWrite(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	start := time.Now()
+	entry := log.WithField("content_length", r.ContentLength).
+		WithField("ip", remoteIp(r))
+	entry.Debug("Sending OTLP metrics to tsdb ...")
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Error("Error when decoding data:" + err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error("Error when getting data from response:" + err.Error())
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	// MetricsData has the same fields as ExportMetricsServiceRequest, whose package needs grpc
+	otlpReq := &metricspb.MetricsData{}
+	switch mediaType {
+	case "application/x-protobuf":
+		err = proto.Unmarshal(data, otlpReq)
+	case "application/json":
+		err = unmarshalOTLPJSON(data, otlpReq)
+	default:
+		http.Error(w, "unsupported content type "+mediaType, http.StatusUnsupportedMediaType)
+		log.Error("Error when decoding data: unsupported content type " + mediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error("Error when decoding data:" + err.Error())
+		return
+	}
+
+	converter := newOTLPConverter(h.writeConfig.OTLP)
+	req := converter.convert(otlpReq)
+	if !h.writeRequest(w, entry, req, nil) {
+		return
+	}
+
+	if converter.rejected > 0 {
+		writeDropped.WithLabelValues("otlp_data_point").Add(float64(converter.rejected))
+		entry.WithField("rejected", converter.rejected).
+			Warn("OTLP data points rejected: " + converter.rejectReason())
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(otlpResponse(mediaType, converter.rejected, converter.rejectReason()))
+	entry.Debugf(
+		"Finished sending OTLP metrics to tsdb in %s .",
+		time.Since(start).String(),
+	)
+}
+
+// otlpResponse encodes an ExportMetricsServiceResponse with partial success when data points were rejected
+func otlpResponse(mediaType string, rejected int, reason string) []byte {
+	if mediaType == "application/json" {
+		if rejected == 0 {
+			return []byte("{}")
+		}
+		b, _ := json.Marshal(map[string]interface{}{
+			"partialSuccess": map[string]string{
+				"rejectedDataPoints": strconv.Itoa(rejected),
+				"errorMessage":       reason,
+			},
+		})
+		return b
+	}
+	if rejected == 0 {
+		return nil
+	}
+	var partialSuccess []byte
+	partialSuccess = protowire.AppendTag(partialSuccess, 1, protowire.VarintType)
+	partialSuccess = protowire.AppendVarint(partialSuccess, uint64(rejected))
+	partialSuccess = protowire.AppendTag(partialSuccess, 2, protowire.BytesType)
+	partialSuccess = protowire.AppendString(partialSuccess, reason)
+	resp := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(resp, partialSuccess)
+}
+
+// unmarshalOTLPJSON decodes OTLP/JSON, unknown fields are ignored as OTLP asks receivers to do.
+// Trace and span ids are hex encoded in OTLP/JSON while protojson decodes bytes from base64,
+// hex text being valid base64 it is found back by encoding the ids again.
+func unmarshalOTLPJSON(data []byte, otlpReq *metricspb.MetricsData) error {
+	err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, otlpReq)
+	if err != nil {
+		return err
+	}
+	for _, rm := range otlpReq.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				for _, e := range otlpExemplars(metric) {
+					if e.TraceId, err = otlpHexId(e.TraceId); err != nil {
+						return fmt.Errorf("invalid trace id: %s", err.Error())
+					}
+					if e.SpanId, err = otlpHexId(e.SpanId); err != nil {
+						return fmt.Errorf("invalid span id: %s", err.Error())
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func otlpHexId(id []byte) ([]byte, error) {
+	if len(id) == 0 {
+		return id, nil
+	}
+	return hex.DecodeString(base64.RawStdEncoding.EncodeToString(id))
+}
+
+// otlpExemplars gives exemplars of all data points of a metric
+func otlpExemplars(metric *metricspb.Metric) []*metricspb.Exemplar {
+	var exemplars []*metricspb.Exemplar
+	switch data := metric.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.DataPoints {
+			exemplars = append(exemplars, dp.Exemplars...)
+		}
+	case *metricspb.Metric_Sum:
+		for _, dp := range data.Sum.DataPoints {
+			exemplars = append(exemplars, dp.Exemplars...)
+		}
+	case *metricspb.Metric_Histogram:
+		for _, dp := range data.Histogram.DataPoints {
+			exemplars = append(exemplars, dp.Exemplars...)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		for _, dp := range data.ExponentialHistogram.DataPoints {
+			exemplars = append(exemplars, dp.Exemplars...)
+		}
+	}
+	return exemplars
+}
+
+// otlpConverter converts OTLP metrics to a remote write request with names and labels made
+// as prometheus does: names are sanitized and suffixed with their unit, monotonic sums with _total,
+// histograms and summaries are split in classic series and exponential histograms become native histograms.
+// Only cumulative data points are accepted, others are rejected.
+type otlpConverter struct {
+	config   OTLPConfig
+	req      *prompb.WriteRequest
+	rejected int
+	reasons  map[string]bool
+}
+
+func newOTLPConverter(config OTLPConfig) *otlpConverter {
+	return &otlpConverter{
+		config:  config,
+		req:     &prompb.WriteRequest{},
+		reasons: make(map[string]bool),
+	}
+}
+
+func (c *otlpConverter) convert(otlpReq *metricspb.MetricsData) *prompb.WriteRequest {
+	for _, rm := range otlpReq.ResourceMetrics {
+		resourceLabels := c.resourceLabels(rm.Resource)
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				c.convertMetric(metric, resourceLabels)
+			}
+		}
+	}
+	return c.req
+}
+
+func (c *otlpConverter) convertMetric(metric *metricspb.Metric, resourceLabels map[string]string) {
+	name := otlpMetricName(metric)
+	metadata := prompb.MetricMetadata{
+		MetricFamilyName: name,
+		Help:             metric.Description,
+		Unit:             otlpUnit(metric.Unit, metric.GetGauge() != nil),
+	}
+	switch data := metric.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		metadata.Type = prompb.MetricMetadata_GAUGE
+		for _, dp := range data.Gauge.DataPoints {
+			c.addNumber(name, resourceLabels, dp)
+		}
+	case *metricspb.Metric_Sum:
+		metadata.Type = prompb.MetricMetadata_GAUGE
+		if data.Sum.IsMonotonic {
+			metadata.Type = prompb.MetricMetadata_COUNTER
+		}
+		if !c.isCumulative(data.Sum.AggregationTemporality, len(data.Sum.DataPoints)) {
+			return
+		}
+		for _, dp := range data.Sum.DataPoints {
+			c.addNumber(name, resourceLabels, dp)
+		}
+	case *metricspb.Metric_Histogram:
+		metadata.Type = prompb.MetricMetadata_HISTOGRAM
+		if !c.isCumulative(data.Histogram.AggregationTemporality, len(data.Histogram.DataPoints)) {
+			return
+		}
+		for _, dp := range data.Histogram.DataPoints {
+			c.addHistogram(name, resourceLabels, dp)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		metadata.Type = prompb.MetricMetadata_HISTOGRAM
+		if !c.isCumulative(data.ExponentialHistogram.AggregationTemporality, len(data.ExponentialHistogram.DataPoints)) {
+			return
+		}
+		for _, dp := range data.ExponentialHistogram.DataPoints {
+			c.addExpHistogram(name, resourceLabels, dp)
+		}
+	case *metricspb.Metric_Summary:
+		metadata.Type = prompb.MetricMetadata_SUMMARY
+		for _, dp := range data.Summary.DataPoints {
+			c.addSummary(name, resourceLabels, dp)
+		}
+	default:
+		return
+	}
+	c.req.Metadata = append(c.req.Metadata, metadata)
+}
+
+func (c *otlpConverter) isCumulative(temporality metricspb.AggregationTemporality, nbPoints int) bool {
+	if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		return true
+	}
+	c.reject(nbPoints, "only cumulative temporality is supported")
+	return false
+}
+
+func (c *otlpConverter) reject(nbPoints int, reason string) {
+	if nbPoints == 0 {
+		return
+	}
+	c.rejected += nbPoints
+	c.reasons[reason] = true
+}
+
+func (c *otlpConverter) rejectReason() string {
+	reasons := make([]string, 0, len(c.reasons))
+	for reason := range c.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// resourceLabels gives job and instance labels from service attributes and promoted attributes
+func (c *otlpConverter) resourceLabels(resource *resourcepb.Resource) map[string]string {
+	attributes := make(map[string]string, len(resource.GetAttributes()))
+	for _, kv := range resource.GetAttributes() {
+		attributes[kv.Key] = otlpValueString(kv.Value)
+	}
+	labels := make(map[string]string)
+	for _, name := range c.config.PromoteResourceAttributes {
+		if value, ok := attributes[name]; ok {
+			addOTLPLabel(labels, name, value)
+		}
+	}
+	if service, ok := attributes["service.name"]; ok {
+		if namespace := attributes["service.namespace"]; namespace != "" {
+			service = namespace + "/" + service
+		}
+		labels["job"] = service
+	}
+	if instance, ok := attributes["service.instance.id"]; ok {
+		labels["instance"] = instance
+	}
+	return labels
+}
+
+func (c *otlpConverter) addSeries(name string, labels map[string]string, value float64, timestamp int64, exemplars []prompb.Exemplar) {
+	c.req.Timeseries = append(c.req.Timeseries, prompb.TimeSeries{
+		Labels:    otlpSeriesLabels(name, labels),
+		Samples:   []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		Exemplars: exemplars,
+	})
+}
+
+func (c *otlpConverter) addNumber(name string, resourceLabels map[string]string, dp *metricspb.NumberDataPoint) {
+	var value float64
+	switch v := dp.Value.(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		value = v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		value = float64(v.AsInt)
+	}
+	if dp.Flags&otlpNoRecordedValue != 0 {
+		value = math.Float64frombits(staleNaN)
+	}
+	exemplars := make([]prompb.Exemplar, 0, len(dp.Exemplars))
+	for _, e := range dp.Exemplars {
+		exemplars = append(exemplars, otlpExemplarToProto(e))
+	}
+	c.addSeries(name, otlpLabels(resourceLabels, dp.Attributes), value, otlpTimestamp(dp.TimeUnixNano), exemplars)
+}
+
+func (c *otlpConverter) addHistogram(name string, resourceLabels map[string]string, dp *metricspb.HistogramDataPoint) {
+	labels := otlpLabels(resourceLabels, dp.Attributes)
+	timestamp := otlpTimestamp(dp.TimeUnixNano)
+	stale := dp.Flags&otlpNoRecordedValue != 0
+	value := func(v float64) float64 {
+		if stale {
+			return math.Float64frombits(staleNaN)
+		}
+		return v
+	}
+
+	// exemplars are set on the bucket they fall in
+	exemplars := make(map[int][]prompb.Exemplar)
+	for _, e := range dp.Exemplars {
+		exemplar := otlpExemplarToProto(e)
+		i := sort.Search(len(dp.ExplicitBounds), func(i int) bool {
+			return dp.ExplicitBounds[i] >= exemplar.Value
+		})
+		exemplars[i] = append(exemplars[i], exemplar)
+	}
+
+	c.addSeries(name+"_count", labels, value(float64(dp.Count)), timestamp, nil)
+	if dp.Sum != nil {
+		c.addSeries(name+"_sum", labels, value(*dp.Sum), timestamp, nil)
+	}
+	cumulative := uint64(0)
+	for i, bound := range dp.ExplicitBounds {
+		if i < len(dp.BucketCounts) {
+			cumulative += dp.BucketCounts[i]
+		}
+		c.addSeries(name+"_bucket", withOTLPLabel(labels, model.BucketLabel, formatBound(bound)),
+			value(float64(cumulative)), timestamp, exemplars[i])
+	}
+	c.addSeries(name+"_bucket", withOTLPLabel(labels, model.BucketLabel, "+Inf"),
+		value(float64(dp.Count)), timestamp, exemplars[len(dp.ExplicitBounds)])
+}
+
+func (c *otlpConverter) addExpHistogram(name string, resourceLabels map[string]string, dp *metricspb.ExponentialHistogramDataPoint) {
+	if dp.Scale < minHistogramSchema {
+		c.reject(1, fmt.Sprintf("exponential histogram scale must be at least %d", minHistogramSchema))
+		return
+	}
+	// buckets are merged to the most precise schema supported by prometheus
+	schema, scaleDown := dp.Scale, int32(0)
+	if schema > maxHistogramSchema {
+		schema, scaleDown = maxHistogramSchema, dp.Scale-maxHistogramSchema
+	}
+	h := prompb.Histogram{
+		Count:         &prompb.Histogram_CountInt{CountInt: dp.Count},
+		Schema:        schema,
+		ZeroThreshold: dp.ZeroThreshold,
+		ZeroCount:     &prompb.Histogram_ZeroCountInt{ZeroCountInt: dp.ZeroCount},
+		Timestamp:     otlpTimestamp(dp.TimeUnixNano),
+	}
+	if dp.Sum != nil {
+		h.Sum = *dp.Sum
+	}
+	if dp.Flags&otlpNoRecordedValue != 0 {
+		h.Sum = math.Float64frombits(staleNaN)
+	}
+	h.PositiveSpans, h.PositiveDeltas = otlpBucketsToSpans(dp.Positive, scaleDown)
+	h.NegativeSpans, h.NegativeDeltas = otlpBucketsToSpans(dp.Negative, scaleDown)
+
+	exemplars := make([]prompb.Exemplar, 0, len(dp.Exemplars))
+	for _, e := range dp.Exemplars {
+		exemplars = append(exemplars, otlpExemplarToProto(e))
+	}
+	c.req.Timeseries = append(c.req.Timeseries, prompb.TimeSeries{
+		Labels:     otlpSeriesLabels(name, otlpLabels(resourceLabels, dp.Attributes)),
+		Histograms: []prompb.Histogram{h},
+		Exemplars:  exemplars,
+	})
+}
+
+func (c *otlpConverter) addSummary(name string, resourceLabels map[string]string, dp *metricspb.SummaryDataPoint) {
+	labels := otlpLabels(resourceLabels, dp.Attributes)
+	timestamp := otlpTimestamp(dp.TimeUnixNano)
+	value := func(v float64) float64 {
+		if dp.Flags&otlpNoRecordedValue != 0 {
+			return math.Float64frombits(staleNaN)
+		}
+		return v
+	}
+	c.addSeries(name+"_count", labels, value(float64(dp.Count)), timestamp, nil)
+	c.addSeries(name+"_sum", labels, value(dp.Sum), timestamp, nil)
+	for _, q := range dp.QuantileValues {
+		c.addSeries(name, withOTLPLabel(labels, model.QuantileLabel, formatBound(q.Quantile)),
+			value(q.Value), timestamp, nil)
+	}
+}
+
+// otlpBucketsToSpans converts exponential buckets to native histogram spans and deltas,
+// an OTLP bucket at index i is the native histogram one at index i+1 as bounds are inclusive on the other side.
+func otlpBucketsToSpans(buckets *metricspb.ExponentialHistogramDataPoint_Buckets, scaleDown int32) ([]prompb.BucketSpan, []int64) {
+	var indexes []int32
+	var counts []int64
+	for i, count := range buckets.GetBucketCounts() {
+		index := (buckets.GetOffset()+int32(i))>>uint(scaleDown) + 1
+		if n := len(indexes); n > 0 && indexes[n-1] == index {
+			counts[n-1] += int64(count)
+			continue
+		}
+		indexes = append(indexes, index)
+		counts = append(counts, int64(count))
+	}
+
+	var spans []prompb.BucketSpan
+	deltas := make([]int64, 0, len(counts))
+	previous := int64(0)
+	for i, index := range indexes {
+		switch {
+		case i == 0:
+			spans = append(spans, prompb.BucketSpan{Offset: index})
+		case index != indexes[i-1]+1:
+			spans = append(spans, prompb.BucketSpan{Offset: index - indexes[i-1] - 1})
+		}
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, counts[i]-previous)
+		previous = counts[i]
+	}
+	return spans, deltas
+}
+
+func otlpExemplarToProto(e *metricspb.Exemplar) prompb.Exemplar {
+	exemplar := prompb.Exemplar{Timestamp: otlpTimestamp(e.TimeUnixNano)}
+	switch v := e.Value.(type) {
+	case *metricspb.Exemplar_AsDouble:
+		exemplar.Value = v.AsDouble
+	case *metricspb.Exemplar_AsInt:
+		exemplar.Value = float64(v.AsInt)
+	}
+	labels := otlpLabels(nil, e.FilteredAttributes)
+	if len(e.TraceId) > 0 {
+		labels["trace_id"] = hex.EncodeToString(e.TraceId)
+	}
+	if len(e.SpanId) > 0 {
+		labels["span_id"] = hex.EncodeToString(e.SpanId)
+	}
+	for name, value := range labels {
+		exemplar.Labels = append(exemplar.Labels, prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(exemplar.Labels, func(i, j int) bool {
+		return exemplar.Labels[i].Name < exemplar.Labels[j].Name
+	})
+	return exemplar
+}
+
+func otlpTimestamp(unixNano uint64) int64 {
+	return int64(unixNano) / int64(time.Millisecond)
+}
+
+func otlpSeriesLabels(name string, labels map[string]string) []prompb.Label {
+	promLabels := make([]prompb.Label, 0, len(labels)+1)
+	promLabels = append(promLabels, prompb.Label{Name: model.MetricNameLabel, Value: name})
+	for labelName, labelValue := range labels {
+		promLabels = append(promLabels, prompb.Label{Name: labelName, Value: labelValue})
+	}
+	sort.Slice(promLabels, func(i, j int) bool {
+		return promLabels[i].Name < promLabels[j].Name
+	})
+	return promLabels
+}
+
+// otlpLabels merges data point attributes with resource labels
+func otlpLabels(resourceLabels map[string]string, attributes []*commonpb.KeyValue) map[string]string {
+	labels := make(map[string]string, len(resourceLabels)+len(attributes))
+	for name, value := range resourceLabels {
+		labels[name] = value
+	}
+	for _, kv := range attributes {
+		addOTLPLabel(labels, kv.Key, otlpValueString(kv.Value))
+	}
+	return labels
+}
+
+// otlpValueString gives attribute value as a label value, arrays and maps are JSON encoded
+func otlpValueString(v *commonpb.AnyValue) string {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(value.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(value.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(value.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue:
+		b, _ := json.Marshal(otlpValueJSON(v))
+		return string(b)
+	}
+	return ""
+}
+
+func otlpValueJSON(v *commonpb.AnyValue) interface{} {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]interface{}, len(value.ArrayValue.GetValues()))
+		for i, v := range value.ArrayValue.GetValues() {
+			values[i] = otlpValueJSON(v)
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]interface{}, len(value.KvlistValue.GetValues()))
+		for _, kv := range value.KvlistValue.GetValues() {
+			values[kv.Key] = otlpValueJSON(kv.Value)
+		}
+		return values
+	}
+	return otlpValueString(v)
+}
+
+func withOTLPLabel(labels map[string]string, name, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for n, v := range labels {
+		result[n] = v
+	}
+	result[name] = value
+	return result
+}
+
+// addOTLPLabel sets an attribute as label, values of attributes having the same sanitized name are joined by ;
+func addOTLPLabel(labels map[string]string, name, value string) {
+	name = sanitizeName(name, false)
+	if existing, ok := labels[name]; ok {
+		value = existing + ";" + value
+	}
+	labels[name] = value
+}
+
+var otlpUnits = map[string]string{
+	"d":    "days",
+	"h":    "hours",
+	"min":  "minutes",
+	"s":    "seconds",
+	"ms":   "milliseconds",
+	"us":   "microseconds",
+	"ns":   "nanoseconds",
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+	"m":    "meters",
+	"V":    "volts",
+	"A":    "amperes",
+	"J":    "joules",
+	"W":    "watts",
+	"g":    "grams",
+	"Cel":  "celsius",
+	"Hz":   "hertz",
+	"%":    "percent",
+}
+
+var otlpUnitAnnotation = regexp.MustCompile(`\{[^}]*\}`)
+
+var otlpPerUnits = map[string]string{
+	"s":  "second",
+	"m":  "minute",
+	"h":  "hour",
+	"d":  "day",
+	"w":  "week",
+	"mo": "month",
+	"y":  "year",
+}
+
+// otlpUnit gives the prometheus unit of a UCUM unit, annotations in braces are removed
+// and dimensionless unit 1 is a ratio for gauges.
+func otlpUnit(unit string, gauge bool) string {
+	unit = otlpUnitAnnotation.ReplaceAllString(unit, "")
+	if unit == "1" {
+		if gauge {
+			return "ratio"
+		}
+		return ""
+	}
+	main, per := unit, ""
+	if i := strings.Index(unit, "/"); i >= 0 {
+		main, per = unit[:i], unit[i+1:]
+	}
+	if u, ok := otlpUnits[main]; ok {
+		main = u
+	}
+	if u, ok := otlpPerUnits[per]; ok {
+		per = u
+	}
+	result := main
+	if per != "" {
+		if result != "" {
+			result += "_"
+		}
+		result += "per_" + per
+	}
+	return strings.Trim(sanitizeName(result, false), "_")
+}
+
+func otlpMetricName(metric *metricspb.Metric) string {
+	name := sanitizeName(metric.Name, true)
+	unit := otlpUnit(metric.Unit, metric.GetGauge() != nil)
+	if unit != "" && !strings.Contains(name, unit) {
+		name += "_" + unit
+	}
+	if metric.GetSum().GetIsMonotonic() && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
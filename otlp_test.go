@@ -0,0 +1,340 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func otlpAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// otlpTestRequest puts metrics in a resource of service api
+func otlpTestRequest(metrics ...*metricspb.Metric) *metricspb.MetricsData {
+	return &metricspb.MetricsData{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{otlpAttribute("service.name", "api")},
+			},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func otlpGauge(name, unit string, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Unit: unit,
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: points}},
+	}
+}
+
+func otlpSum(name, unit string, monotonic bool, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Unit: unit,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            monotonic,
+		}},
+	}
+}
+
+func otlpDouble(value float64, timeMs int64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		TimeUnixNano: uint64(timeMs) * 1000000,
+		Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+func TestOTLPMetricName(t *testing.T) {
+	tests := []struct {
+		metric *metricspb.Metric
+		name   string
+		unit   string
+	}{
+		{otlpGauge("process.memory.usage", "By"), "process_memory_usage_bytes", "bytes"},
+		{otlpGauge("cpu.utilization", "1"), "cpu_utilization_ratio", "ratio"},
+		{otlpGauge("network.throughput", "By/s"), "network_throughput_bytes_per_second", "bytes_per_second"},
+		{otlpGauge("events.rate", "{event}/m"), "events_rate_per_minute", "per_minute"},
+		{otlpGauge("room_temperature_celsius", "Cel"), "room_temperature_celsius", "celsius"},
+		{otlpGauge("2xx.count", "widgets"), "_2xx_count_widgets", "widgets"},
+		{otlpSum("http.requests", "{request}", true), "http_requests_total", ""},
+		{otlpSum("requests_total", "1", true), "requests_total", ""},
+		{otlpSum("queue.length", "", false), "queue_length", ""},
+		{otlpSum("http.server.duration", "ms", true), "http_server_duration_milliseconds_total", "milliseconds"},
+	}
+	for _, test := range tests {
+		t.Run(test.metric.Name, func(t *testing.T) {
+			if name := otlpMetricName(test.metric); name != test.name {
+				t.Errorf("name is %s, expected %s", name, test.name)
+			}
+			if unit := otlpUnit(test.metric.Unit, test.metric.GetGauge() != nil); unit != test.unit {
+				t.Errorf("unit is %s, expected %s", unit, test.unit)
+			}
+		})
+	}
+}
+
+func TestOTLPBucketsToSpans(t *testing.T) {
+	tests := []struct {
+		name      string
+		buckets   *metricspb.ExponentialHistogramDataPoint_Buckets
+		scaleDown int32
+		spans     []prompb.BucketSpan
+		deltas    []int64
+	}{
+		{
+			name:   "no buckets",
+			deltas: []int64{},
+		},
+		{
+			name:    "index shifted by one",
+			buckets: &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{1, 2, 3}},
+			spans:   []prompb.BucketSpan{{Offset: 1, Length: 3}},
+			deltas:  []int64{1, 1, 1},
+		},
+		{
+			name:    "negative offset and empty bucket",
+			buckets: &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: -2, BucketCounts: []uint64{1, 0, 2}},
+			spans:   []prompb.BucketSpan{{Offset: -1, Length: 3}},
+			deltas:  []int64{1, -1, 2},
+		},
+		{
+			name:      "buckets merged by scale down",
+			buckets:   &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{1, 2, 3, 4}},
+			scaleDown: 1,
+			spans:     []prompb.BucketSpan{{Offset: 1, Length: 2}},
+			deltas:    []int64{3, 4},
+		},
+		{
+			name:      "negative offset merged by scale down",
+			buckets:   &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: -3, BucketCounts: []uint64{1, 1, 1}},
+			scaleDown: 1,
+			spans:     []prompb.BucketSpan{{Offset: -1, Length: 2}},
+			deltas:    []int64{1, 1},
+		},
+		{
+			name:      "two scales down",
+			buckets:   &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 3, BucketCounts: []uint64{5, 1, 1, 1, 1, 2}},
+			scaleDown: 2,
+			spans:     []prompb.BucketSpan{{Offset: 1, Length: 3}},
+			deltas:    []int64{5, -1, -2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spans, deltas := otlpBucketsToSpans(test.buckets, test.scaleDown)
+			if !reflect.DeepEqual(spans, test.spans) {
+				t.Errorf("spans are %v, expected %v", spans, test.spans)
+			}
+			if !reflect.DeepEqual(deltas, test.deltas) {
+				t.Errorf("deltas are %v, expected %v", deltas, test.deltas)
+			}
+		})
+	}
+}
+
+func TestOTLPConvertHistogram(t *testing.T) {
+	sum := 7.5
+	histogram := &metricspb.Metric{
+		Name: "http.server.duration",
+		Unit: "s",
+		Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints: []*metricspb.HistogramDataPoint{{
+				Attributes:     []*commonpb.KeyValue{otlpAttribute("http.method", "GET")},
+				TimeUnixNano:   2000000000,
+				Count:          6,
+				Sum:            &sum,
+				BucketCounts:   []uint64{1, 2, 3},
+				ExplicitBounds: []float64{0.5, 1},
+				Exemplars: []*metricspb.Exemplar{{
+					TimeUnixNano: 1500000000,
+					Value:        &metricspb.Exemplar_AsDouble{AsDouble: 0.7},
+					TraceId:      []byte{0x01, 0xab},
+				}},
+			}},
+		}},
+	}
+	req := newOTLPConverter(OTLPConfig{}).convert(otlpTestRequest(histogram))
+
+	series := func(name string, value float64, le string, exemplars []prompb.Exemplar) prompb.TimeSeries {
+		labels := []prompb.Label{{Name: "__name__", Value: name}}
+		if le != "" {
+			labels = append(labels, prompb.Label{Name: "http_method", Value: "GET"}, prompb.Label{Name: "job", Value: "api"})
+			labels = append(labels, prompb.Label{Name: "le", Value: le})
+		} else {
+			labels = append(labels, prompb.Label{Name: "http_method", Value: "GET"}, prompb.Label{Name: "job", Value: "api"})
+		}
+		return prompb.TimeSeries{
+			Labels:    labels,
+			Samples:   []prompb.Sample{{Value: value, Timestamp: 2000}},
+			Exemplars: exemplars,
+		}
+	}
+	expected := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			series("http_server_duration_seconds_count", 6, "", nil),
+			series("http_server_duration_seconds_sum", 7.5, "", nil),
+			series("http_server_duration_seconds_bucket", 1, "0.5", nil),
+			series("http_server_duration_seconds_bucket", 3, "1", []prompb.Exemplar{{
+				Labels:    []prompb.Label{{Name: "trace_id", Value: "01ab"}},
+				Value:     0.7,
+				Timestamp: 1500,
+			}}),
+			series("http_server_duration_seconds_bucket", 6, "+Inf", nil),
+		},
+		Metadata: []prompb.MetricMetadata{{
+			Type:             prompb.MetricMetadata_HISTOGRAM,
+			MetricFamilyName: "http_server_duration_seconds",
+			Unit:             "seconds",
+		}},
+	}
+	if !reflect.DeepEqual(req, expected) {
+		t.Errorf("request is\n%v\nexpected\n%v", req, expected)
+	}
+}
+
+func TestOTLPConvertRejectsDelta(t *testing.T) {
+	delta := otlpSum("requests", "", true, otlpDouble(1, 1000), otlpDouble(2, 2000))
+	delta.GetSum().AggregationTemporality = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	converter := newOTLPConverter(OTLPConfig{})
+	req := converter.convert(otlpTestRequest(delta, otlpGauge("up", "", otlpDouble(1, 1000))))
+	if converter.rejected != 2 || converter.rejectReason() != "only cumulative temporality is supported" {
+		t.Errorf("rejected %d data points: %s", converter.rejected, converter.rejectReason())
+	}
+	if len(req.Timeseries) != 1 || req.Timeseries[0].Labels[0].Value != "up" {
+		t.Errorf("series are %v, only up was expected", req.Timeseries)
+	}
+}
+
+func TestOTLPConvertStaleMarkers(t *testing.T) {
+	noValue := uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)
+	stalePoint := otlpDouble(5, 1000)
+	stalePoint.Flags = noValue
+	sum := 3.0
+	req := newOTLPConverter(OTLPConfig{}).convert(otlpTestRequest(
+		otlpGauge("temperature", "", stalePoint),
+		&metricspb.Metric{
+			Name: "latency",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricspb.HistogramDataPoint{{
+					Count:          2,
+					Sum:            &sum,
+					BucketCounts:   []uint64{1, 1},
+					ExplicitBounds: []float64{1},
+					Flags:          noValue,
+				}},
+			}},
+		},
+		&metricspb.Metric{
+			Name: "rpc",
+			Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: []*metricspb.SummaryDataPoint{{
+					Count:          2,
+					Sum:            3,
+					QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{{Quantile: 0.5, Value: 1}},
+					Flags:          noValue,
+				}},
+			}},
+		},
+		&metricspb.Metric{
+			Name: "size",
+			Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricspb.ExponentialHistogramDataPoint{{
+					Count: 2,
+					Sum:   &sum,
+					Flags: noValue,
+				}},
+			}},
+		},
+		otlpGauge("humidity", "", otlpDouble(40, 1000)),
+	))
+
+	if len(req.Timeseries) != 10 {
+		t.Fatalf("got %d series, expected 10", len(req.Timeseries))
+	}
+	for _, ts := range req.Timeseries[:8] {
+		if math.Float64bits(ts.Samples[0].Value) != staleNaN {
+			t.Errorf("series %v is not marked stale", ts.Labels)
+		}
+	}
+	if h := req.Timeseries[8].Histograms; len(h) != 1 || math.Float64bits(h[0].Sum) != staleNaN {
+		t.Errorf("exponential histogram %v is not marked stale", h)
+	}
+	if value := req.Timeseries[9].Samples[0].Value; value != 40 {
+		t.Errorf("humidity is %v, expected 40", value)
+	}
+}
+
+func TestUnmarshalOTLPJSON(t *testing.T) {
+	data := []byte(`{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+		"schemaUrl": "https://opentelemetry.io/schemas/1.21.0",
+		"scopeMetrics": [{"metrics": [{
+			"name": "queue.size",
+			"gauge": {"dataPoints": [{
+				"attributes": [{"key": "shard", "value": {"intValue": "3"}}],
+				"timeUnixNano": "1000000000",
+				"asInt": "12",
+				"exemplars": [{
+					"timeUnixNano": "900000000",
+					"asDouble": 11,
+					"traceId": "5b8efff798038103d269b633813fc60c",
+					"spanId": "eee19b7ec3c1b174"
+				}],
+				"futureField": true
+			}]}
+		}]}]
+	}]}`)
+	otlpReq := &metricspb.MetricsData{}
+	if err := unmarshalOTLPJSON(data, otlpReq); err != nil {
+		t.Fatal(err)
+	}
+	req := newOTLPConverter(OTLPConfig{}).convert(otlpReq)
+	expected := []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "queue_size"},
+			{Name: "job", Value: "api"},
+			{Name: "shard", Value: "3"},
+		},
+		Samples: []prompb.Sample{{Value: 12, Timestamp: 1000}},
+		Exemplars: []prompb.Exemplar{{
+			Labels: []prompb.Label{
+				{Name: "span_id", Value: "eee19b7ec3c1b174"},
+				{Name: "trace_id", Value: "5b8efff798038103d269b633813fc60c"},
+			},
+			Value:     11,
+			Timestamp: 900,
+		}},
+	}}
+	if !reflect.DeepEqual(req.Timeseries, expected) {
+		t.Errorf("series are\n%v\nexpected\n%v", req.Timeseries, expected)
+	}
+}
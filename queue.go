@@ -0,0 +1,510 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt         = ".seg"
+	recordHeaderSize   = 8
+	defaultSegmentSize = 8 * 1024 * 1024
+)
+
+var (
+	ErrQueueClosed      = errors.New("queue is closed")
+	ErrQueueReadStopped = errors.New("queue reading is stopped")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type QueueConfig struct {
+	Dir         string                 `yaml:"dir"`
+	SegmentSize int64                  `yaml:"segment_size"`
+	MaxSize     int64                  `yaml:"max_size"`
+	MaxAge      time.Duration          `yaml:"max_age"`
+	Sync        bool                   `yaml:"sync"`
+	XXX         map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *QueueConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain QueueConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Dir == "" {
+		return fmt.Errorf("Config queue: dir must be set")
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = defaultSegmentSize
+	}
+	if c.MaxSize > 0 && c.MaxSize < c.SegmentSize {
+		return fmt.Errorf("Config queue: max_size must be greater than segment_size (%d)", c.SegmentSize)
+	}
+	return checkOverflow(c.XXX, "Config queue")
+}
+
+type segment struct {
+	seq     int
+	size    int64
+	modTime time.Time
+}
+
+// Queue is a persistent fifo queue stored in segment files inside a directory.
+// Each record is stored with its length and a crc32 checksum, records are appended
+// to the last segment (the active one) and are read back from the oldest segment.
+// Segments are removed once fully read or when they exceed the queue limits.
+// There is a single reader which must acknowledge each record with Commit, it holds reader
+// token while reading so a queue kept across config reloads is not read twice.
+type Queue struct {
+	config   QueueConfig
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	size     int64
+	notify   chan struct{}
+	done     chan struct{}
+	closed   bool
+	reader   chan struct{}
+
+	readFile    *os.File
+	readOffset  int64
+	pendingData []byte
+}
+
+func NewQueue(config QueueConfig) (*Queue, error) {
+	err := os.MkdirAll(config.Dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		config: config,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		reader: make(chan struct{}, 1),
+	}
+
+	files, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != segmentExt {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(f.Name(), segmentExt))
+		if err != nil {
+			continue
+		}
+		size, err := repairSegment(q.segmentPath(seq), f.Size())
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			os.Remove(q.segmentPath(seq))
+			continue
+		}
+		q.segments = append(q.segments, &segment{seq, size, f.ModTime()})
+		q.size += size
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+	if len(q.segments) > 0 {
+		log.Infof("Replaying %d segments (%d bytes) from queue %s", len(q.segments), q.size, config.Dir)
+	}
+
+	nextSeq := 1
+	if len(q.segments) > 0 {
+		nextSeq = q.segments[len(q.segments)-1].seq + 1
+	}
+	err = q.openSegment(nextSeq)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Append stores a record at the end of the queue and wakes up the reader
+func (q *Queue) Append(data []byte) error {
+	rec := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(data, crcTable))
+	copy(rec[recordHeaderSize:], data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.config.MaxSize > 0 && int64(len(rec)) > q.config.MaxSize {
+		return fmt.Errorf("record of %d bytes exceeds queue max size", len(rec))
+	}
+
+	active := q.activeSegment()
+	if active.size > 0 && active.size+int64(len(rec)) > q.config.SegmentSize {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+		active = q.activeSegment()
+	}
+
+	_, err := q.active.Write(rec)
+	if err != nil {
+		// remove any partial record to keep segment readable
+		q.active.Truncate(active.size)
+		return err
+	}
+	if q.config.Sync {
+		err = q.active.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	active.size += int64(len(rec))
+	active.modTime = time.Now()
+	q.size += int64(len(rec))
+	q.enforceLimits()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Next returns the oldest record not yet committed, it blocks until a record is available,
+// the queue is closed or stop is closed. Calling Next again without Commit returns the same record.
+func (q *Queue) Next(stop <-chan struct{}) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrQueueClosed
+		}
+		if q.pendingData != nil {
+			data := q.pendingData
+			q.mu.Unlock()
+			return data, nil
+		}
+		q.enforceLimits()
+
+		seg := q.segments[0]
+		if q.readOffset < seg.size {
+			data, err := q.readRecord(seg)
+			if err == nil {
+				q.pendingData = data
+				q.mu.Unlock()
+				return data, nil
+			}
+			log.Errorf(
+				"Queue segment %s is unreadable after %d bytes, skipping the remaining of the segment: %s",
+				q.segmentPath(seg.seq), q.readOffset, err.Error(),
+			)
+			q.skipSegment()
+			q.mu.Unlock()
+			continue
+		}
+		if len(q.segments) > 1 {
+			// segment has been fully read
+			q.removeOldest()
+			q.mu.Unlock()
+			continue
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-q.done:
+		case <-stop:
+			return nil, ErrQueueReadStopped
+		}
+	}
+}
+
+// Commit acknowledges the record returned by Next, it will not be given back again
+func (q *Queue) Commit() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pendingData == nil {
+		// segment has been dropped meanwhile
+		return
+	}
+	q.readOffset += int64(recordHeaderSize + len(q.pendingData))
+	q.pendingData = nil
+}
+
+// Segments returns the number of segment files in queue
+func (q *Queue) Segments() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.segments)
+}
+
+// Size returns the number of bytes stored in queue segments
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// setConfig changes queue limits, dir must stay the same
+func (q *Queue) setConfig(config QueueConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.config = config
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	if q.readFile != nil {
+		q.readFile.Close()
+	}
+	err := q.active.Sync()
+	if err != nil {
+		q.active.Close()
+		return err
+	}
+	return q.active.Close()
+}
+
+func (q *Queue) segmentPath(seq int) string {
+	return filepath.Join(q.config.Dir, fmt.Sprintf("%08d%s", seq, segmentExt))
+}
+
+func (q *Queue) activeSegment() *segment {
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) openSegment(seq int) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	q.active = f
+	q.segments = append(q.segments, &segment{seq: seq, modTime: time.Now()})
+	return nil
+}
+
+func (q *Queue) rotate() error {
+	err := q.active.Sync()
+	if err != nil {
+		return err
+	}
+	err = q.active.Close()
+	if err != nil {
+		return err
+	}
+	return q.openSegment(q.activeSegment().seq + 1)
+}
+
+// enforceLimits drops the oldest segments when queue is bigger than max size
+// or when their last record is older than max age, lock must be held.
+func (q *Queue) enforceLimits() {
+	now := time.Now()
+	active := q.activeSegment()
+	if q.config.MaxAge > 0 && active.size > 0 && now.Sub(active.modTime) > q.config.MaxAge {
+		err := q.rotate()
+		if err != nil {
+			log.Errorf("Error when rotating queue segment %s: %s", q.segmentPath(active.seq), err.Error())
+		}
+	}
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+		tooBig := q.config.MaxSize > 0 && q.size > q.config.MaxSize
+		tooOld := q.config.MaxAge > 0 && now.Sub(oldest.modTime) > q.config.MaxAge
+		if !tooBig && !tooOld {
+			return
+		}
+		log.Warnf(
+			"Dropping queue segment %s (%d bytes not shipped) which exceeds queue limits.",
+			q.segmentPath(oldest.seq), oldest.size-q.readOffset,
+		)
+		queueDroppedBytes.Add(float64(oldest.size - q.readOffset))
+		q.removeOldest()
+	}
+}
+
+// removeOldest deletes the segment being read, lock must be held
+func (q *Queue) removeOldest() {
+	oldest := q.segments[0]
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	q.readOffset = 0
+	q.pendingData = nil
+	err := os.Remove(q.segmentPath(oldest.seq))
+	if err != nil {
+		log.Errorf("Error when removing queue segment %s: %s", q.segmentPath(oldest.seq), err.Error())
+	}
+	q.size -= oldest.size
+	q.segments = q.segments[1:]
+}
+
+// skipSegment goes to the next segment or to the end of the active one, lock must be held
+func (q *Queue) skipSegment() {
+	queueDroppedBytes.Add(float64(q.segments[0].size - q.readOffset))
+	if len(q.segments) > 1 {
+		q.removeOldest()
+		return
+	}
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	q.readOffset = q.segments[0].size
+}
+
+// readRecord reads the record at current read offset of the given segment, lock must be held
+func (q *Queue) readRecord(seg *segment) ([]byte, error) {
+	if q.readFile == nil {
+		f, err := os.Open(q.segmentPath(seg.seq))
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Seek(q.readOffset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		q.readFile = f
+	}
+	data, err := readRecord(q.readFile)
+	if err != nil {
+		q.readFile.Close()
+		q.readFile = nil
+		return nil, err
+	}
+	return data, nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return data, nil
+}
+
+// repairSegment truncates a segment after its last valid record,
+// last record can be partially written when adapter has crashed.
+func repairSegment(path string, size int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var valid int64
+	for valid < size {
+		data, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		valid += int64(recordHeaderSize + len(data))
+	}
+	if valid == size {
+		return size, nil
+	}
+	log.Warnf("Queue segment %s is corrupted after %d bytes, truncating it.", path, valid)
+	queueDroppedBytes.Add(float64(size - valid))
+	err = f.Truncate(valid)
+	if err != nil {
+		return 0, err
+	}
+	return valid, nil
+}
+
+// openQueues are shared by backend writers of successive configs, a queue is opened by the first writer
+// using its dir and closed when its last writer is closed
+var openQueues = struct {
+	sync.Mutex
+	queues map[string]*sharedQueue
+}{queues: make(map[string]*sharedQueue)}
+
+type sharedQueue struct {
+	queue *Queue
+	refs  int
+}
+
+// acquireQueue opens the queue of config dir or gives the one already open with new limits
+func acquireQueue(config QueueConfig) (*Queue, error) {
+	openQueues.Lock()
+	defer openQueues.Unlock()
+	dir := filepath.Clean(config.Dir)
+	if shared, ok := openQueues.queues[dir]; ok {
+		shared.refs++
+		shared.queue.setConfig(config)
+		return shared.queue, nil
+	}
+	q, err := NewQueue(config)
+	if err != nil {
+		return nil, err
+	}
+	openQueues.queues[dir] = &sharedQueue{queue: q, refs: 1}
+	return q, nil
+}
+
+// releaseQueue closes the queue when it is no more used
+func releaseQueue(q *Queue) error {
+	openQueues.Lock()
+	defer openQueues.Unlock()
+	q.mu.Lock()
+	dir := filepath.Clean(q.config.Dir)
+	q.mu.Unlock()
+	shared, ok := openQueues.queues[dir]
+	if !ok || shared.queue != q {
+		return q.Close()
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	delete(openQueues.queues, dir)
+	return q.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueRecord encodes data as Append writes it in a segment
+func queueRecord(data string) []byte {
+	rec := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum([]byte(data), crcTable))
+	copy(rec[recordHeaderSize:], data)
+	return rec
+}
+
+func testQueueDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// readQueue gives every record available in queue, each record is given twice by Next before being committed
+func readQueue(t *testing.T, q *Queue) []string {
+	stop := make(chan struct{})
+	close(stop)
+	var records []string
+	for {
+		data, err := q.Next(stop)
+		if err == ErrQueueReadStopped {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := q.Next(stop)
+		if err != nil || string(again) != string(data) {
+			t.Fatalf("Next without Commit gave %q (%v) after %q", again, err, data)
+		}
+		q.Commit()
+		records = append(records, string(data))
+	}
+}
+
+func TestRepairSegment(t *testing.T) {
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	corrupt := queueRecord("bb")
+	corrupt[recordHeaderSize] = 'x'
+	tests := []struct {
+		name    string
+		content []byte
+		size    int64
+		records []string
+	}{
+		{"valid records", join(queueRecord("a"), queueRecord("bb")), 2*recordHeaderSize + 3, []string{"a", "bb"}},
+		{"truncated header", join(queueRecord("a"), queueRecord("bb")[:5]), recordHeaderSize + 1, []string{"a"}},
+		{"truncated data", join(queueRecord("a"), queueRecord("bb")[:recordHeaderSize+1]), recordHeaderSize + 1, []string{"a"}},
+		{"corrupt record", join(queueRecord("a"), corrupt, queueRecord("c")), recordHeaderSize + 1, []string{"a"}},
+		{"corrupt first record", join(corrupt, queueRecord("c")), 0, nil},
+		{"empty", nil, 0, nil},
+	}
+	for _, test := range tests {
+		dir := testQueueDir(t)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "00000001"+segmentExt)
+		if err := ioutil.WriteFile(path, test.content, 0640); err != nil {
+			t.Fatal(err)
+		}
+		size, err := repairSegment(path, int64(len(test.content)))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if size != test.size {
+			t.Errorf("%s: got size %d, want %d", test.name, size, test.size)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != test.size {
+			t.Errorf("%s: segment is not truncated to %d bytes: %v %v", test.name, test.size, info, err)
+		}
+
+		// repaired segment is replayed when queue is opened
+		if err := ioutil.WriteFile(path, test.content, 0640); err != nil {
+			t.Fatal(err)
+		}
+		q, err := NewQueue(QueueConfig{Dir: dir, SegmentSize: defaultSegmentSize})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if records := readQueue(t, q); !reflect.DeepEqual(records, test.records) {
+			t.Errorf("%s: got records %q, want %q", test.name, records, test.records)
+		}
+		q.Close()
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	// each record of 30 bytes takes 38 bytes in its own segment
+	records := []string{"0", "1", "2", "3", "4", "5"}
+	tests := []struct {
+		name   string
+		config QueueConfig
+		// aged is the number of oldest segments whose last record is older than max age
+		aged     int
+		records  []string
+		segments int
+	}{
+		{"no limits", QueueConfig{SegmentSize: 64}, 0, records, 6},
+		{"max size", QueueConfig{SegmentSize: 64, MaxSize: 128}, 0, []string{"3", "4", "5"}, 3},
+		{"max size of several records per segment", QueueConfig{SegmentSize: 80, MaxSize: 160}, 0, []string{"2", "3", "4", "5"}, 2},
+		{"max age", QueueConfig{SegmentSize: 64, MaxAge: time.Hour}, 2, []string{"2", "3", "4", "5"}, 4},
+		{"max age of active segment", QueueConfig{SegmentSize: 64, MaxAge: time.Hour}, 6, nil, 1},
+	}
+	for _, test := range tests {
+		dir := testQueueDir(t)
+		defer os.RemoveAll(dir)
+		test.config.Dir = dir
+		q, err := NewQueue(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			if err := q.Append([]byte(r + string(make([]byte, 29)))); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		q.mu.Lock()
+		for _, s := range q.segments[:test.aged] {
+			s.modTime = time.Now().Add(-2 * time.Hour)
+		}
+		q.enforceLimits()
+		q.mu.Unlock()
+		if q.Segments() != test.segments {
+			t.Errorf("%s: got %d segments, want %d", test.name, q.Segments(), test.segments)
+		}
+		var got []string
+		for _, r := range readQueue(t, q) {
+			got = append(got, r[:1])
+		}
+		if !reflect.DeepEqual(got, test.records) {
+			t.Errorf("%s: got records %q, want %q", test.name, got, test.records)
+		}
+		q.Close()
+	}
+}
+
+func TestQueueNextCommit(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentSize int64
+		appends     []string
+		// commits is the number of records read and committed before reopen
+		commits  int
+		reopen   bool
+		records  []string
+		segments int
+	}{
+		{"one segment", defaultSegmentSize, []string{"a", "b", "c"}, 1, false, []string{"b", "c"}, 1},
+		{"across segments", 10, []string{"a", "b", "c"}, 2, false, []string{"c"}, 1},
+		{"reopen replays the segment being read", 10, []string{"a", "b", "c"}, 2, true, []string{"b", "c"}, 1},
+		{"reopen after a fully read segment", 10, []string{"a", "b", "c"}, 1, true, []string{"a", "b", "c"}, 1},
+		{"reopen in one segment", defaultSegmentSize, []string{"a", "b", "c"}, 2, true, []string{"a", "b", "c"}, 1},
+	}
+	for _, test := range tests {
+		dir := testQueueDir(t)
+		defer os.RemoveAll(dir)
+		config := QueueConfig{Dir: dir, SegmentSize: test.segmentSize}
+		q, err := NewQueue(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range test.appends {
+			if err := q.Append([]byte(a)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < test.commits; i++ {
+			data, err := q.Next(nil)
+			if err != nil || string(data) != test.appends[i] {
+				t.Fatalf("%s: Next gave %q (%v), want %q", test.name, data, err, test.appends[i])
+			}
+			q.Commit()
+		}
+		if test.reopen {
+			q.Close()
+			if q, err = NewQueue(config); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if records := readQueue(t, q); !reflect.DeepEqual(records, test.records) {
+			t.Errorf("%s: got records %q, want %q", test.name, records, test.records)
+		}
+		if q.Segments() != test.segments {
+			t.Errorf("%s: got %d segments after reading, want %d", test.name, q.Segments(), test.segments)
+		}
+		q.Close()
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultReadConfig = ReadConfig{
+	Timeout: 30 * time.Second,
+}
+
+type ReadConfig struct {
+	Timeout        time.Duration          `yaml:"timeout"`
+	PartialResults bool                   `yaml:"partial_results"`
+	XXX            map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *ReadConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultReadConfig
+	type plain ReadConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("Config read: timeout must be greater than 0")
+	}
+	return checkOverflow(c.XXX, "Config read")
+}
+
+// federatedRead queries backends in parallel and merges their results,
+// when partial results are allowed failing backends are skipped if at least one has answered
+func (h adapterHandler) federatedRead(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	readers := make([]*BackendWriter, 0, len(h.backends))
+	for _, b := range h.backends {
+		if b.noRead {
+			continue
+		}
+		readers = append(readers, b)
+	}
+	if len(readers) == 0 {
+		return nil, errors.New("no backend is enabled for read")
+	}
+	if h.metricPrefix != "" {
+		req = prefixReadRequest(req, h.metricPrefix)
+	}
+
+	resps := make([]*prompb.ReadResponse, len(readers))
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i, b := range readers {
+		wg.Add(1)
+		go func(i int, b *BackendWriter) {
+			defer wg.Done()
+			resps[i], errs[i] = b.read(ctx, req)
+		}(i, b)
+	}
+	wg.Wait()
+
+	var failures []string
+	succeeded := make([]*prompb.ReadResponse, 0, len(readers))
+	for i, err := range errs {
+		if err != nil {
+			readsFailed.WithLabelValues(readers[i].Name()).Inc()
+			failures = append(failures, readers[i].Name()+": "+err.Error())
+			continue
+		}
+		succeeded = append(succeeded, resps[i])
+	}
+	if len(failures) > 0 {
+		err := errors.New(strings.Join(failures, "; "))
+		if !h.readConfig.PartialResults || len(succeeded) == 0 {
+			return nil, err
+		}
+		log.Warn("Sending partial results, some backends failed to read: " + err.Error())
+	}
+	resp := mergeReadResponses(succeeded)
+	if h.metricPrefix != "" {
+		trimMetricPrefix(resp, h.metricPrefix)
+	}
+	return resp, nil
+}
+
+// seriesReader gives the backend to read when it is the only one and can send series one by one
+func (h adapterHandler) seriesReader() *BackendWriter {
+	var reader *BackendWriter
+	for _, b := range h.backends {
+		if b.noRead {
+			continue
+		}
+		if reader != nil {
+			return nil
+		}
+		reader = b
+	}
+	if reader == nil || !reader.streamsSeries() {
+		return nil
+	}
+	return reader
+}
+
+// readSeries reads a query on a single backend, series are encoded in chunks as they are received
+func (h adapterHandler) readSeries(ctx context.Context, b *BackendWriter, q *prompb.Query) ([]*prompb.ChunkedSeries, error) {
+	if h.metricPrefix != "" {
+		q = prefixReadRequest(&prompb.ReadRequest{Queries: []*prompb.Query{q}}, h.metricPrefix).Queries[0]
+	}
+	var series []*prompb.ChunkedSeries
+	err := b.readSeries(ctx, q, func(ts *prompb.TimeSeries) error {
+		if h.metricPrefix != "" {
+			trimSeriesPrefix(ts, h.metricPrefix)
+		}
+		series = append(series, encodeSeries(ts))
+		return nil
+	})
+	if err != nil {
+		readsFailed.WithLabelValues(b.Name()).Inc()
+		return nil, err
+	}
+	return series, nil
+}
+
+// federatedReadSeries reads a query with federatedRead and encodes its series in chunks
+func (h adapterHandler) federatedReadSeries(ctx context.Context, q *prompb.Query) ([]*prompb.ChunkedSeries, error) {
+	resp, err := h.federatedRead(ctx, &prompb.ReadRequest{
+		Queries: []*prompb.Query{q},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var series []*prompb.ChunkedSeries
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			series = append(series, encodeSeries(ts))
+		}
+	}
+	return series, nil
+}
+
+// mergeReadResponses merges series with the same labels in results of the same query,
+// on identical timestamps the sample from the first response is kept
+func mergeReadResponses(resps []*prompb.ReadResponse) *prompb.ReadResponse {
+	if len(resps) == 1 {
+		return resps[0]
+	}
+	var results []map[string]*prompb.TimeSeries
+	var keys [][]string
+	for _, resp := range resps {
+		for i, result := range resp.Results {
+			if i >= len(results) {
+				results = append(results, map[string]*prompb.TimeSeries{})
+				keys = append(keys, nil)
+			}
+			for _, ts := range result.Timeseries {
+				k := labelsKey(ts.Labels)
+				merged, ok := results[i][k]
+				if !ok {
+					results[i][k] = &prompb.TimeSeries{
+						Labels:  ts.Labels,
+						Samples: ts.Samples,
+					}
+					keys[i] = append(keys[i], k)
+					continue
+				}
+				merged.Samples = mergeSamples(merged.Samples, ts.Samples)
+			}
+		}
+	}
+
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(results)),
+	}
+	for i, series := range results {
+		resp.Results[i] = &prompb.QueryResult{
+			Timeseries: make([]*prompb.TimeSeries, 0, len(series)),
+		}
+		for _, k := range keys[i] {
+			resp.Results[i].Timeseries = append(resp.Results[i].Timeseries, series[k])
+		}
+	}
+	return resp
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// generation is the handler built from a config with the backend writers it owns
+type generation struct {
+	// requests hold read lock so backends are closed once requests served with them are finished
+	mu       sync.RWMutex
+	closed   bool
+	config   *Config
+	auth     *Authenticator
+	handler  http.Handler
+	backends []*BackendWriter
+}
+
+func newGeneration(config *Config) (*generation, error) {
+	g := &generation{config: config}
+	var err error
+	if config.Auth != nil {
+		g.auth, err = NewAuthenticator(*config.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Tenants) == 0 {
+		for _, backendConfig := range config.Backends {
+			backendWriter, err := NewBackendWriter(*backendConfig, config.Write)
+			if err != nil {
+				g.closeBackends()
+				return nil, err
+			}
+			g.backends = append(g.backends, backendWriter)
+		}
+		g.handler = NewAdapterHandler(g.backends, config.Read, config.Write, g.auth)
+		return g, nil
+	}
+	tenants := make([]*Tenant, 0, len(config.Tenants))
+	for _, tenantConfig := range config.Tenants {
+		tenant, err := NewTenant(*tenantConfig, config.Write)
+		if err != nil {
+			g.closeBackends()
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+		g.backends = append(g.backends, tenant.backends...)
+	}
+	g.handler = NewTenantsHandler(tenants, config.TenantFrom, config.TenantHeader, config.Read, config.Write, g.auth)
+	return g, nil
+}
+
+// serve gives false when generation has been replaced and closed meanwhile
+func (g *generation) serve(w http.ResponseWriter, r *http.Request) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		return false
+	}
+	g.handler.ServeHTTP(w, r)
+	return true
+}
+
+// close waits for requests being served then closes backends
+func (g *generation) close() error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	return g.closeBackends()
+}
+
+func (g *generation) closeBackends() error {
+	var lastErr error
+	for _, b := range g.backends {
+		err := b.Close()
+		if err != nil {
+			log.Errorf("Could not flush queue of backend %s, queued samples may be lost: %s", b.Name(), err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ReloadHandler serves requests with the handler built from last valid config. Config file is reloaded
+// on SIGHUP or on POST /-/reload and replaces running config only when it is valid, backends of
+// previous config are closed once their requests are finished, their queues are kept by new backends
+// using the same queue dir.
+type ReloadHandler struct {
+	source  ConfigSource
+	mu      sync.Mutex
+	current atomic.Value
+	closing sync.WaitGroup
+}
+
+func NewReloadHandler(source ConfigSource, config *Config) (*ReloadHandler, error) {
+	g, err := newGeneration(config)
+	if err != nil {
+		return nil, err
+	}
+	h := &ReloadHandler{source: source}
+	h.current.Store(g)
+	go h.reloadOnSighup()
+	return h, nil
+}
+
+func (h *ReloadHandler) generation() *generation {
+	return h.current.Load().(*generation)
+}
+
+// Config gives the running config
+func (h *ReloadHandler) Config() *Config {
+	return h.generation().config
+}
+
+func (h *ReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/-/reload" {
+		h.generation().auth.require(permissionWrite, h.serveReload)(w, r)
+		return
+	}
+	for !h.generation().serve(w, r) {
+	}
+}
+
+func (h *ReloadHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := h.Reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "config reloaded from %s\n", h.source.File)
+}
+
+func (h *ReloadHandler) reloadOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		h.Reload()
+	}
+}
+
+// Reload loads config file and swaps it with the running one, an invalid config is rejected
+// and the running one is kept
+func (h *ReloadHandler) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	config, err := h.source.Load()
+	if err != nil {
+		log.Errorf("Invalid config in %s, keeping running config: %s", h.source.File, err.Error())
+		return err
+	}
+	old := h.generation()
+	if config.ListenAddr != old.config.ListenAddr || !reflect.DeepEqual(config.ListenTLS, old.config.ListenTLS) {
+		log.Warn("Changes of listen_addr and listen_tls are only applied on restart.")
+	}
+	g, err := newGeneration(config)
+	if err != nil {
+		log.Errorf("Could not apply config from %s, keeping running config: %s", h.source.File, err.Error())
+		return err
+	}
+	h.current.Store(g)
+	config.loadLogConfig()
+	h.closing.Add(1)
+	go func() {
+		defer h.closing.Done()
+		old.close()
+	}()
+	log.Infof("Config reloaded from %s", h.source.File)
+	return nil
+}
+
+// Close closes backends of running config once backends of previous configs are closed, it is called
+// when server is shut down, ctx bounds the time given to requests still served by previous configs
+func (h *ReloadHandler) Close(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		h.closing.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		log.Warn("Requests are still served with a previous config, its queues may not be flushed.")
+	}
+	// requests interrupted by shutdown may still hold current config, backends are closed anyway
+	g := h.generation()
+	return g.closeBackends()
+}
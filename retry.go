@@ -0,0 +1,173 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+type RetryConfig struct {
+	MaxAttempts    int                    `yaml:"max_attempts"`
+	InitialBackoff time.Duration          `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration          `yaml:"max_backoff"`
+	Multiplier     float64                `yaml:"multiplier"`
+	Jitter         float64                `yaml:"jitter"`
+	XXX            map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *RetryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRetryConfig
+	type plain RetryConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 1
+	}
+	if c.Multiplier < 1 {
+		return fmt.Errorf("Config retry: multiplier must be greater or equal to 1")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("Config retry: jitter must be between 0 and 1")
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = c.InitialBackoff
+	}
+	return checkOverflow(c.XXX, "Config retry")
+}
+
+// backoff gives time to wait before the given attempt, attempts start at 1 for the first retry
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	b := float64(c.InitialBackoff) * math.Pow(c.Multiplier, float64(attempt-1))
+	if b > float64(c.MaxBackoff) {
+		b = float64(c.MaxBackoff)
+	}
+	if c.Jitter > 0 {
+		b += b * c.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(b)
+}
+
+// ResilientAdapter retries calls to an adapter which fail with a recoverable error
+// and stops calling it through a circuit breaker when the tsdb keeps failing.
+type ResilientAdapter struct {
+	Adapter
+	retry   RetryConfig
+	breaker *CircuitBreaker
+}
+
+func NewResilientAdapter(name string, adapter Adapter, retry RetryConfig, breakerConfig CircuitBreakerConfig) *ResilientAdapter {
+	return &ResilientAdapter{
+		Adapter: adapter,
+		retry:   retry,
+		breaker: NewCircuitBreaker(name, breakerConfig),
+	}
+}
+
+func (a *ResilientAdapter) Write(samples model.Samples) (int, error) {
+	var written int
+	err := a.do(context.Background(), "write", nil, func() error {
+		var err error
+		written, err = a.Adapter.Write(samples)
+		return err
+	})
+	return written, err
+}
+
+func (a *ResilientAdapter) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	var resp *prompb.ReadResponse
+	err := a.do(ctx, "read", nil, func() error {
+		var err error
+		resp, err = a.Adapter.Read(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// StreamsSeries tells if series can be read one by one with ReadSeries
+func (a *ResilientAdapter) StreamsSeries() bool {
+	_, ok := a.Adapter.(SeriesStreamer)
+	return ok
+}
+
+// ReadSeries is retried only while no series has been sent, the adapter must be a SeriesStreamer
+func (a *ResilientAdapter) ReadSeries(ctx context.Context, q *prompb.Query, send func(*prompb.TimeSeries) error) error {
+	streamer := a.Adapter.(SeriesStreamer)
+	sent := false
+	return a.do(ctx, "read", func() bool { return !sent }, func() error {
+		return streamer.ReadSeries(ctx, q, func(ts *prompb.TimeSeries) error {
+			sent = true
+			return send(ts)
+		})
+	})
+}
+
+// Healthy asks tsdb once, bypassing retry and circuit breaker: a probe must answer fast
+// and must not open the breaker which also gates writes, breaker state is given by BreakerState
+func (a *ResilientAdapter) Healthy() bool {
+	return a.Adapter.Healthy()
+}
+
+func (a *ResilientAdapter) BreakerState() string {
+	return a.breaker.State()
+}
+
+// do calls the adapter until it succeeds or fails with an unrecoverable error, retries stop when ctx is done
+// or when canRetry, if given, returns false. Calls cancelled by ctx are not reported to the circuit breaker
+func (a *ResilientAdapter) do(ctx context.Context, action string, canRetry func() bool, call func() error) error {
+	var err error
+	for attempt := 0; attempt < a.retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := a.retry.backoff(attempt)
+			log.Debugf("Retrying %s on %s in %s: %s", action, a.breaker.name, backoff.String(), err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		if allowErr := a.breaker.Allow(); allowErr != nil {
+			if err != nil {
+				return err
+			}
+			return NewRecoverableError(allowErr)
+		}
+		err = call()
+		if err != nil && ctx.Err() != nil {
+			return NewRecoverableError(err)
+		}
+		// data rejected by tsdb means it is up and running
+		a.breaker.Report(err == nil || !IsRecoverable(err))
+		if err == nil || !IsRecoverable(err) || (canRetry != nil && !canRetry()) {
+			return err
+		}
+	}
+	return err
+}
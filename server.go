@@ -20,26 +20,73 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfigCommand(os.Args[2:]))
+	}
 	var configPath string
-	flag.StringVar(&configPath, "config", "config.yml", "Set config file path.")
+	var sets stringsFlag
+	flag.StringVar(&configPath, "config", "", "Set config file path (default to $PFR_CONFIG or config.yml).")
+	flag.Var(&sets, "set", "Set a config field, overriding config file and PFR_* environment variables (e.g. -set read.timeout=1m), can be repeated.")
 	flag.Parse()
 
-	config, err := LoadFile(configPath)
+	source := NewConfigSource(configPath, sets)
+	config, err := source.Load()
+	if err != nil {
+		log.Panic(err)
+	}
+	config.loadLogConfig()
+	handler, err := NewReloadHandler(source, config)
 	if err != nil {
 		log.Panic(err)
 	}
-	adapter := NewKairosAdapter(config.KairosUrl, createClient(config.SkipInsecure, config.Workers))
-	log.Infof("Server is started and listen at %s\n", config.ListenAddr)
-	http.ListenAndServe(config.ListenAddr, NewAdapterHandler(adapter, config.Workers))
+	server := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: handler,
+	}
+	if config.ListenTLS != nil {
+		server.TLSConfig, err = NewTLSConfig(*config.ListenTLS, config.Auth != nil && config.Auth.ClientCAFile != "")
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Infof("Server is started and listen with TLS at %s\n", config.ListenAddr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("Server is started and listen at %s\n", config.ListenAddr)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	os.Exit(waitShutdown(server, handler))
 }
-func createClient(skipInsecure bool, workers int) *http.Client {
+
+// stringsFlag is a flag which can be given several times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func createClient(backend string, skipInsecure bool, workers int) *http.Client {
 	maxIdleConnsPerHost := workers * 5
 	return &http.Client{
-		Transport: &http.Transport{
+		Transport: instrumentTransport(backend, &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
 				KeepAlive: 30 * time.Second,
@@ -50,10 +97,10 @@ func createClient(skipInsecure bool, workers int) *http.Client {
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-			Proxy: http.ProxyFromEnvironment,
+			Proxy:                 http.ProxyFromEnvironment,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: skipInsecure,
 			},
-		},
+		}),
 	}
 }
@@ -0,0 +1,63 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitShutdown blocks until SIGTERM or SIGINT, then stops accepting connections and lets in-flight
+// requests finish within shutdown timeout before closing backend queues. It returns the exit status: 1 when
+// requests were interrupted, samples failed or were dropped while draining or a queue could not be flushed,
+// meaning that data may have been lost.
+func waitShutdown(server *http.Server, handler *ReloadHandler) int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	lost := samplesLost()
+	timeout := handler.Config().ShutdownTimeout
+	log.Infof("Received %s, draining requests for up to %s", sig, timeout.String())
+	go func() {
+		sig := <-signals
+		log.Errorf("Received %s again, exiting without draining requests", sig)
+		os.Exit(1)
+	}()
+
+	status := 0
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Errorf("Requests still running after %s are interrupted, their samples may be lost: %s", timeout.String(), err.Error())
+		status = 1
+	}
+	err = handler.Close(ctx)
+	if err != nil {
+		status = 1
+	}
+	if drained := samplesLost() - lost; drained > 0 {
+		log.Errorf("%.0f samples failed or were dropped while draining requests", drained)
+		status = 1
+	}
+	if status == 0 {
+		log.Info("All requests drained, exiting.")
+	}
+	return status
+}
@@ -0,0 +1,311 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	tenantFromHeader    = "header"
+	tenantFromBasicAuth = "basic_auth"
+	tenantFromPath      = "path"
+
+	defaultTenantHeader = "X-Scope-OrgID"
+)
+
+// TenantConfig isolates data of a tenant either in its own backends or under a metric prefix in top-level backends
+type TenantConfig struct {
+	Name         string                 `yaml:"name"`
+	MetricPrefix string                 `yaml:"metric_prefix"`
+	Backends     []*BackendConfig       `yaml:"backends"`
+	Workers      int                    `yaml:"workers"`
+	BatchSize    int                    `yaml:"batch_size"`
+	RateLimit    float64                `yaml:"rate_limit"`
+	RateBurst    int                    `yaml:"rate_burst"`
+	XXX          map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *TenantConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TenantConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return fmt.Errorf("Config tenants: name must be set")
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return fmt.Errorf("Config tenant %s: rate_limit and rate_burst can't be negative", c.Name)
+	}
+	if c.RateBurst == 0 {
+		c.RateBurst = int(math.Ceil(c.RateLimit))
+	}
+	return checkOverflow(c.XXX, "Config tenant "+c.Name)
+}
+
+// loadTenants checks how tenants are found and gives to tenants without backends a copy of top-level ones,
+// with their own queue sub-directory.
+func (c *Config) loadTenants() error {
+	if len(c.Tenants) == 0 {
+		return nil
+	}
+	switch c.TenantFrom {
+	case "":
+		c.TenantFrom = tenantFromHeader
+	case tenantFromHeader, tenantFromBasicAuth, tenantFromPath:
+	default:
+		return fmt.Errorf(
+			"Config: tenant_from must be %s, %s or %s",
+			tenantFromHeader, tenantFromBasicAuth, tenantFromPath,
+		)
+	}
+	// tenant would be whatever user name the caller sends
+	if c.TenantFrom == tenantFromBasicAuth && (c.Auth == nil || c.Auth.HtpasswdFile == "") {
+		return fmt.Errorf("Config: auth with an htpasswd_file must be set when tenant_from is %s", tenantFromBasicAuth)
+	}
+	if c.TenantHeader == "" {
+		c.TenantHeader = defaultTenantHeader
+	}
+	names := make(map[string]bool)
+	var prefixed []*TenantConfig
+	for _, t := range c.Tenants {
+		if names[t.Name] {
+			return fmt.Errorf("Config tenants: name %s is used by several tenants", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Backends) > 0 {
+			workers, batchSize := t.Workers, t.BatchSize
+			if workers <= 0 {
+				workers = c.Workers
+			}
+			if batchSize <= 0 {
+				batchSize = c.BatchSize
+			}
+			if err := c.loadBackendsDefaults(t.Backends, workers, batchSize, t.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(c.Backends) == 0 {
+			return fmt.Errorf("Config tenant %s: backends must be set when there are no top-level backends", t.Name)
+		}
+		if t.MetricPrefix == "" {
+			return fmt.Errorf("Config tenant %s: metric_prefix must be set to share top-level backends", t.Name)
+		}
+		// reads of a tenant would match metrics of tenants whose prefix starts with its own
+		for _, other := range prefixed {
+			if strings.HasPrefix(t.MetricPrefix, other.MetricPrefix) || strings.HasPrefix(other.MetricPrefix, t.MetricPrefix) {
+				return fmt.Errorf(
+					"Config tenant %s: metric_prefix %s overlaps metric_prefix %s of tenant %s sharing the same backends",
+					t.Name, t.MetricPrefix, other.MetricPrefix, other.Name,
+				)
+			}
+		}
+		prefixed = append(prefixed, t)
+		for _, b := range c.Backends {
+			backend := *b
+			if t.Workers > 0 {
+				backend.Workers = t.Workers
+			}
+			if t.BatchSize > 0 {
+				backend.BatchSize = t.BatchSize
+			}
+			if b.Queue != nil {
+				queue := *b.Queue
+				queue.Dir = filepath.Join(queue.Dir, t.Name)
+				backend.Queue = &queue
+			}
+			t.Backends = append(t.Backends, &backend)
+		}
+	}
+	return c.Auth.checkTenants(names)
+}
+
+// Tenant has its own backend writers, named after the tenant, and its own limits
+type Tenant struct {
+	name         string
+	backends     []*BackendWriter
+	metricPrefix string
+	limiter      *rateLimiter
+}
+
+func NewTenant(config TenantConfig, writeConfig WriteConfig) (*Tenant, error) {
+	t := &Tenant{
+		name:         config.Name,
+		metricPrefix: config.MetricPrefix,
+	}
+	for _, backendConfig := range config.Backends {
+		backendConfig := *backendConfig
+		backendConfig.Name = t.name + "/" + backendConfig.Name
+		backendWriter, err := NewBackendWriter(backendConfig, writeConfig)
+		if err != nil {
+			for _, b := range t.backends {
+				b.Close()
+			}
+			return nil, err
+		}
+		t.backends = append(t.backends, backendWriter)
+	}
+	if config.RateLimit > 0 {
+		t.limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+	return t, nil
+}
+
+// tenantsHandler routes requests to the handler of their tenant, health and metrics are shared
+type tenantsHandler struct {
+	from     string
+	header   string
+	handlers map[string]http.Handler
+	auth     *Authenticator
+}
+
+// NewTenantsHandler serves each tenant with its own backends, tenant is found in a header,
+// in basic auth user or in the first element of url path
+func NewTenantsHandler(tenants []*Tenant, from, header string, readConfig ReadConfig, writeConfig WriteConfig, auth *Authenticator) http.Handler {
+	th := &tenantsHandler{
+		from:     from,
+		header:   header,
+		handlers: make(map[string]http.Handler),
+		auth:     auth,
+	}
+	var backends []*BackendWriter
+	for _, t := range tenants {
+		h := newAdapterHandler(t.backends, readConfig, writeConfig)
+		h.tenant = t.name
+		h.metricPrefix = t.metricPrefix
+		h.limiter = t.limiter
+		h.auth = auth
+		th.handlers[t.name] = h.routes()
+		backends = append(backends, t.backends...)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/health", newAdapterHandler(backends, readConfig, writeConfig).health)
+	r.Handle("/metrics", promhttp.Handler())
+	r.PathPrefix("/").Handler(th)
+	return r
+}
+
+func (th *tenantsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var tenant string
+	switch th.from {
+	case tenantFromHeader:
+		tenant = r.Header.Get(th.header)
+	case tenantFromBasicAuth:
+		tenant, _, _ = r.BasicAuth()
+	case tenantFromPath:
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		i := strings.Index(path, "/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		tenant = path[:i]
+		// request is routed without tenant in its path
+		tenantReq := new(http.Request)
+		*tenantReq = *r
+		tenantURL := *r.URL
+		tenantURL.Path = path[i:]
+		tenantReq.URL = &tenantURL
+		r = tenantReq
+	}
+	// unauthenticated requests are rejected by the tenant handler, authenticated ones only reach their tenants
+	if th.auth != nil {
+		if cred := th.auth.authenticate(r); cred != nil && !cred.allowsTenant(tenant) {
+			log.WithField("remote_addr", r.RemoteAddr).Debugf("%s is not allowed on tenant '%s'", cred.name, tenant)
+			authFailed.WithLabelValues("forbidden").Inc()
+			http.Error(w, fmt.Sprintf("%s is not allowed on tenant '%s'", cred.name, tenant), http.StatusForbidden)
+			return
+		}
+	}
+	handler, ok := th.handlers[tenant]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown tenant '%s'", tenant), http.StatusUnauthorized)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// prefixMetricNames adds tenant prefix to metric names of a write request
+func prefixMetricNames(req *prompb.WriteRequest, prefix string) {
+	for _, ts := range req.Timeseries {
+		for i, l := range ts.Labels {
+			if l.Name == model.MetricNameLabel {
+				ts.Labels[i].Value = prefix + l.Value
+			}
+		}
+	}
+	for i := range req.Metadata {
+		req.Metadata[i].MetricFamilyName = prefix + req.Metadata[i].MetricFamilyName
+	}
+}
+
+// prefixReadRequest restricts queries to metrics of a tenant by adding its prefix to metric name matchers
+func prefixReadRequest(req *prompb.ReadRequest, prefix string) *prompb.ReadRequest {
+	quotedPrefix := regexp.QuoteMeta(prefix)
+	prefixed := &prompb.ReadRequest{
+		Queries:               make([]*prompb.Query, len(req.Queries)),
+		AcceptedResponseTypes: req.AcceptedResponseTypes,
+	}
+	for i, q := range req.Queries {
+		query := *q
+		query.Matchers = []*prompb.LabelMatcher{{
+			Type:  prompb.LabelMatcher_RE,
+			Name:  model.MetricNameLabel,
+			Value: quotedPrefix + ".*",
+		}}
+		for _, m := range q.Matchers {
+			matcher := *m
+			if m.Name == model.MetricNameLabel {
+				switch m.Type {
+				case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+					matcher.Value = prefix + m.Value
+				case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+					matcher.Value = quotedPrefix + "(?:" + m.Value + ")"
+				}
+			}
+			query.Matchers = append(query.Matchers, &matcher)
+		}
+		prefixed.Queries[i] = &query
+	}
+	return prefixed
+}
+
+// trimMetricPrefix removes tenant prefix from metric names of a read response
+func trimMetricPrefix(resp *prompb.ReadResponse, prefix string) {
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			trimSeriesPrefix(ts, prefix)
+		}
+	}
+}
+
+func trimSeriesPrefix(ts *prompb.TimeSeries, prefix string) {
+	for i, l := range ts.Labels {
+		if l.Name == model.MetricNameLabel {
+			ts.Labels[i].Value = strings.TrimPrefix(l.Value, prefix)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type ListenTLSConfig struct {
+	CertFile       string                 `yaml:"cert_file"`
+	KeyFile        string                 `yaml:"key_file"`
+	ClientCAFile   string                 `yaml:"client_ca_file"`
+	MinVersion     string                 `yaml:"min_version"`
+	CipherSuites   []string               `yaml:"cipher_suites"`
+	ReloadInterval time.Duration          `yaml:"reload_interval"`
+	XXX            map[string]interface{} `yaml:",inline" json:"-"`
+
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+var DefaultListenTLSConfig = ListenTLSConfig{
+	MinVersion:     "1.2",
+	ReloadInterval: 30 * time.Second,
+}
+
+func (c *ListenTLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultListenTLSConfig
+	type plain ListenTLSConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("Config listen_tls: cert_file and key_file must be set")
+	}
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return fmt.Errorf("Config listen_tls: min_version must be 1.0, 1.1, 1.2 or 1.3")
+	}
+	c.minVersion = version
+	suites := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s.ID
+	}
+	c.cipherSuites = nil
+	for _, name := range c.CipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return fmt.Errorf("Config listen_tls: unknown cipher suite %s", name)
+		}
+		c.cipherSuites = append(c.cipherSuites, id)
+	}
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("Config listen_tls: reload_interval must be positive")
+	}
+	return checkOverflow(c.XXX, "Config listen_tls")
+}
+
+// certReloader serves the certificate and client CAs last loaded from disk, files are polled
+// and reloaded when they change so rotated certificates are used without restart
+type certReloader struct {
+	config        ListenTLSConfig
+	requestClient bool
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewTLSConfig loads certificates of listen_tls and keeps them up to date, requestClientCert asks clients
+// for a certificate checked later by authentication when listen_tls has no client CA
+func NewTLSConfig(config ListenTLSConfig, requestClientCert bool) (*tls.Config, error) {
+	r := &certReloader{
+		config:        config,
+		requestClient: requestClientCert,
+		modTimes:      make(map[string]time.Time),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return &tls.Config{
+		GetConfigForClient: r.configForClient,
+	}, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	modTimes, err := r.modTimesOnDisk()
+	if err != nil {
+		return err
+	}
+	// failed loads are not retried until files change again
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("listen_tls: no certificate found in %s", r.config.ClientCAFile)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return nil
+}
+
+func (r *certReloader) modTimesOnDisk() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *certReloader) changed() bool {
+	modTimes, err := r.modTimesOnDisk()
+	if err != nil {
+		// file may be replaced right now, it will be seen on next poll
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for f, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls files modification time, a failed reload keeps previous certificates
+func (r *certReloader) watch() {
+	for range time.Tick(r.config.ReloadInterval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Errorf("Could not reload TLS certificates, previous ones are kept: %s", err.Error())
+			continue
+		}
+		log.Infof("TLS certificates reloaded from %s", r.config.CertFile)
+	}
+}
+
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*r.cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   r.config.minVersion,
+		CipherSuites: r.config.cipherSuites,
+	}
+	switch {
+	case r.clientCAs != nil:
+		config.ClientCAs = r.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case r.requestClient:
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config, nil
+}
@@ -15,13 +15,22 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strings"
 	"time"
 )
 
-func protoToSamples(req *prompb.WriteRequest) model.Samples {
+// protoToSamples converts series of a write request to samples, exemplars and native histograms
+// are converted too when write config stores them
+func protoToSamples(req *prompb.WriteRequest, config WriteConfig) model.Samples {
 	var samples model.Samples
 	for _, ts := range req.Timeseries {
 		metric := make(model.Metric, len(ts.Labels))
@@ -36,9 +45,180 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 				Timestamp: model.Time(s.Timestamp),
 			})
 		}
+		if config.Exemplars == writePolicyStore {
+			for _, e := range ts.Exemplars {
+				samples = append(samples, exemplarToSample(metric, e))
+			}
+		}
+		if config.Histograms == writePolicyStore {
+			for _, h := range ts.Histograms {
+				samples = append(samples, histogramToSamples(metric, h)...)
+			}
+		}
 	}
 	return samples
 }
+func countSamples(req *prompb.WriteRequest) int {
+	nb := 0
+	for _, ts := range req.Timeseries {
+		nb += len(ts.Samples)
+	}
+	return nb
+}
+
+func decodeWriteRequest(compressed []byte) (*prompb.WriteRequest, error) {
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var req prompb.WriteRequest
+	err = proto.Unmarshal(reqBuf, &req)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func encodeWriteRequest(req *prompb.WriteRequest) ([]byte, error) {
+	reqBuf, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, reqBuf), nil
+}
+
+// metricToTags splits labels of a metric into a metric name and tags as expected by tsdb using tags,
+// labels with an empty value are skipped as they are equivalent to non-existent labels in prometheus.
+func metricToTags(m model.Metric) (string, map[string]string) {
+	metricName := "none"
+	tags := make(map[string]string)
+	for name, value := range m {
+		sVal := string(value)
+		sName := string(name)
+		if sName == model.MetricNameLabel {
+			metricName = sVal
+		} else if sVal != "" {
+			tags[sName] = sVal
+		}
+	}
+	return metricName, tags
+}
+
+// labelMatcher is a prompb.LabelMatcher with its regex compiled to match labels in adapters
+type labelMatcher struct {
+	*prompb.LabelMatcher
+	re *regexp.Regexp
+}
+
+func newLabelMatchers(matchers []*prompb.LabelMatcher) ([]labelMatcher, error) {
+	result := make([]labelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		lm := labelMatcher{LabelMatcher: m}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			lm.re = re
+		default:
+			return nil, fmt.Errorf("unknown match type %v", m.Type)
+		}
+		result = append(result, lm)
+	}
+	return result, nil
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return value == m.Value
+	case prompb.LabelMatcher_NEQ:
+		return value != m.Value
+	case prompb.LabelMatcher_RE:
+		return m.re.MatchString(value)
+	case prompb.LabelMatcher_NRE:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// regexLiterals gives values matched by a regex when it is only a list of literal values like a|b|c
+func regexLiterals(expr string) ([]string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpAlternate {
+		subs = re.Sub
+	}
+	values := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		values = append(values, string(sub.Rune))
+	}
+	return values, true
+}
+
+// matchLabels tells if a set of labels is selected by all matchers,
+// a missing label is matched as a label with an empty value like prometheus does.
+func matchLabels(matchers []labelMatcher, labels []prompb.Label) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range labels {
+			if l.Name == m.Name {
+				value = l.Value
+				break
+			}
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelsKey gives an unique key for a set of labels whatever their order
+func labelsKey(labels []prompb.Label) string {
+	// 0xff cannot cannot occur in valid UTF-8 sequences, so use it
+	// as a separator here.
+	separator := "\xff"
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+separator+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, separator)
+}
+
+// mergeSamples merges two lists of samples sorted by timestamp,
+// when both lists have a sample at the same timestamp only the one from the first list is kept
+func mergeSamples(a, b []prompb.Sample) []prompb.Sample {
+	result := make([]prompb.Sample, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Timestamp < b[j].Timestamp {
+			result = append(result, a[i])
+			i++
+		} else if a[i].Timestamp > b[j].Timestamp {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
 func escapeSingleQuotes(str string) string {
 	return strings.Replace(str, `'`, `\'`, -1)
 }
@@ -49,3 +229,79 @@ func escapeSlashes(str string) string {
 func msToTime(ms int64) time.Time {
 	return time.Unix(0, ms*int64(time.Millisecond))
 }
+
+// sanitizeName replaces characters not allowed in prometheus names by _,
+// names starting with a digit are prefixed by key_ for labels or _ for metrics
+func sanitizeName(name string, metric bool) string {
+	sanitized := []rune(name)
+	for i, r := range sanitized {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || (metric && r == ':')
+		if !valid {
+			sanitized[i] = '_'
+		}
+	}
+	name = string(sanitized)
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		if metric {
+			return "_" + name
+		}
+		return "key_" + name
+	}
+	return name
+}
+
+// decodeJSONObject reads a json object from decoder, the value of key is read by decodeValue
+// and other values are skipped
+func decodeJSONObject(decoder *json.Decoder, key string, decodeValue func() error) error {
+	if err := expectJSONDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if t != key {
+			var skipped json.RawMessage
+			if err = decoder.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = decodeValue(); err != nil {
+			return err
+		}
+	}
+	return expectJSONDelim(decoder, '}')
+}
+
+// decodeJSONArray reads a json array from decoder, each element is read by decodeElement, null is an empty array
+func decodeJSONArray(decoder *json.Decoder, decodeElement func() error) error {
+	t, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("unexpected %v in json, expecting [", t)
+	}
+	for decoder.More() {
+		if err = decodeElement(); err != nil {
+			return err
+		}
+	}
+	return expectJSONDelim(decoder, ']')
+}
+
+func expectJSONDelim(decoder *json.Decoder, delim json.Delim) error {
+	t, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("unexpected %v in json, expecting %s", t, delim)
+	}
+	return nil
+}
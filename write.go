@@ -0,0 +1,264 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"strconv"
+)
+
+const (
+	writePolicyDrop  = "drop"
+	writePolicyStore = "store"
+
+	// customBucketsSchema is the schema of native histograms with custom bucket bounds
+	customBucketsSchema = -53
+	// customValuesField is the field number of custom bucket bounds, which is not known
+	// by prompb.Histogram and is kept in its unrecognized fields
+	customValuesField = 16
+)
+
+var DefaultWriteConfig = WriteConfig{
+	Exemplars:  writePolicyDrop,
+	Histograms: writePolicyDrop,
+	Metadata:   writePolicyDrop,
+}
+
+// WriteConfig sets what is done with data of write requests which are not float samples,
+// each of them is either stored or counted and dropped
+type WriteConfig struct {
+	Exemplars  string                 `yaml:"exemplars"`
+	Histograms string                 `yaml:"histograms"`
+	Metadata   string                 `yaml:"metadata"`
+	OTLP       OTLPConfig             `yaml:"otlp"`
+	XXX        map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *WriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultWriteConfig
+	type plain WriteConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	policies := map[string]string{
+		"exemplars":  c.Exemplars,
+		"histograms": c.Histograms,
+		"metadata":   c.Metadata,
+	}
+	for name, policy := range policies {
+		if policy != writePolicyDrop && policy != writePolicyStore {
+			return fmt.Errorf("Config write: %s must be %s or %s, got %s", name, writePolicyDrop, writePolicyStore, policy)
+		}
+	}
+	return checkOverflow(c.XXX, "Config write")
+}
+
+// countDropped counts data dropped by write policy in a write request
+func (c WriteConfig) countDropped(req *prompb.WriteRequest) (exemplars, histograms, metadata int) {
+	for _, ts := range req.Timeseries {
+		if c.Exemplars == writePolicyDrop {
+			exemplars += len(ts.Exemplars)
+		}
+		if c.Histograms == writePolicyDrop {
+			histograms += len(ts.Histograms)
+		}
+	}
+	if c.Metadata == writePolicyDrop {
+		metadata = len(req.Metadata)
+	}
+	return exemplars, histograms, metadata
+}
+
+// exemplarToSample stores an exemplar as a sample of the series suffixed by _exemplar,
+// its labels (e.g. trace_id) are added to labels of the series without overriding them
+func exemplarToSample(metric model.Metric, e prompb.Exemplar) *model.Sample {
+	exemplarMetric := metric.Clone()
+	exemplarMetric[model.MetricNameLabel] = metric[model.MetricNameLabel] + "_exemplar"
+	for _, l := range e.Labels {
+		if _, ok := exemplarMetric[model.LabelName(l.Name)]; ok {
+			continue
+		}
+		exemplarMetric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return &model.Sample{
+		Metric:    exemplarMetric,
+		Value:     model.SampleValue(e.Value),
+		Timestamp: model.Time(e.Timestamp),
+	}
+}
+
+// histogramToSamples stores a native histogram as a classic one: _count, _sum
+// and cumulative _bucket series with the upper bound of each populated bucket as le label.
+func histogramToSamples(metric model.Metric, h prompb.Histogram) model.Samples {
+	name := metric[model.MetricNameLabel]
+	timestamp := model.Time(h.Timestamp)
+	newSample := func(suffix string, value float64, le string) *model.Sample {
+		m := metric.Clone()
+		m[model.MetricNameLabel] = name + model.LabelValue(suffix)
+		if le != "" {
+			m[model.BucketLabel] = model.LabelValue(le)
+		}
+		return &model.Sample{
+			Metric:    m,
+			Value:     model.SampleValue(value),
+			Timestamp: timestamp,
+		}
+	}
+
+	count, zeroCount := histogramCounts(h)
+	samples := model.Samples{
+		newSample("_count", count, ""),
+		newSample("_sum", h.Sum, ""),
+	}
+
+	cumulative := 0.0
+	negatives := histogramBuckets(h.NegativeSpans, h.NegativeDeltas, h.NegativeCounts)
+	// negative buckets are sent from the lowest bound, which is the greatest index
+	for i := len(negatives) - 1; i >= 0; i-- {
+		cumulative += negatives[i].count
+		le := -bucketBound(h.Schema, negatives[i].index-1)
+		samples = append(samples, newSample("_bucket", cumulative, formatBound(le)))
+	}
+	if zeroCount > 0 || h.ZeroThreshold > 0 {
+		cumulative += zeroCount
+		samples = append(samples, newSample("_bucket", cumulative, formatBound(h.ZeroThreshold)))
+	}
+	customValues := histogramCustomValues(h)
+	for _, b := range histogramBuckets(h.PositiveSpans, h.PositiveDeltas, h.PositiveCounts) {
+		cumulative += b.count
+		var bound float64
+		if h.Schema != customBucketsSchema {
+			bound = bucketBound(h.Schema, b.index)
+		} else if b.index >= 0 && int(b.index) < len(customValues) {
+			bound = customValues[b.index]
+		} else {
+			// last custom bucket has no bound and is counted in +Inf one
+			continue
+		}
+		samples = append(samples, newSample("_bucket", cumulative, formatBound(bound)))
+	}
+	return append(samples, newSample("_bucket", count, "+Inf"))
+}
+
+// histogramCustomValues gives bucket bounds of a histogram with custom buckets
+func histogramCustomValues(h prompb.Histogram) []float64 {
+	if h.Schema != customBucketsSchema {
+		return nil
+	}
+	var values []float64
+	b := h.XXX_unrecognized
+	for len(b) > 0 {
+		field, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return values
+		}
+		b = b[n:]
+		switch {
+		case field == customValuesField && wireType == protowire.BytesType:
+			var packed []byte
+			packed, n = protowire.ConsumeBytes(b)
+			for len(packed) > 0 {
+				v, m := protowire.ConsumeFixed64(packed)
+				if m < 0 {
+					return values
+				}
+				values = append(values, math.Float64frombits(v))
+				packed = packed[m:]
+			}
+		case field == customValuesField && wireType == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			if n >= 0 {
+				values = append(values, math.Float64frombits(v))
+			}
+		default:
+			n = protowire.ConsumeFieldValue(field, wireType, b)
+		}
+		if n < 0 {
+			return values
+		}
+		b = b[n:]
+	}
+	return values
+}
+
+func histogramCounts(h prompb.Histogram) (count float64, zeroCount float64) {
+	switch c := h.Count.(type) {
+	case *prompb.Histogram_CountInt:
+		count = float64(c.CountInt)
+	case *prompb.Histogram_CountFloat:
+		count = c.CountFloat
+	}
+	switch c := h.ZeroCount.(type) {
+	case *prompb.Histogram_ZeroCountInt:
+		zeroCount = float64(c.ZeroCountInt)
+	case *prompb.Histogram_ZeroCountFloat:
+		zeroCount = c.ZeroCountFloat
+	}
+	return count, zeroCount
+}
+
+type histogramBucket struct {
+	index int32
+	count float64
+}
+
+// histogramBuckets resolves bucket indexes from spans, counts are absolute for float histograms
+// and deltas from previous bucket for integer ones
+func histogramBuckets(spans []prompb.BucketSpan, deltas []int64, counts []float64) []histogramBucket {
+	var buckets []histogramBucket
+	var index int32
+	var current int64
+	i := 0
+	for s, span := range spans {
+		if s == 0 {
+			index = span.Offset
+		} else {
+			index += span.Offset
+		}
+		for j := uint32(0); j < span.Length; j++ {
+			var count float64
+			switch {
+			case i < len(deltas):
+				current += deltas[i]
+				count = float64(current)
+			case i < len(counts):
+				count = counts[i]
+			default:
+				return buckets
+			}
+			buckets = append(buckets, histogramBucket{index, count})
+			index++
+			i++
+		}
+	}
+	return buckets
+}
+
+// bucketBound is the upper bound of a positive bucket which is base^index with base = 2^(2^-schema)
+func bucketBound(schema int32, index int32) float64 {
+	if schema <= 0 {
+		return math.Ldexp(1, int(index)<<uint(-schema))
+	}
+	return math.Exp2(float64(index) / float64(int64(1)<<uint(schema)))
+}
+
+func formatBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
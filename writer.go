@@ -0,0 +1,291 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	minShipBackoff = 100 * time.Millisecond
+	maxShipBackoff = 30 * time.Second
+)
+
+// BackendWriter sends samples to a single backend with its own worker pool and queue,
+// so a slow or failing backend doesn't hold data meant to the other ones.
+// It also reads from the backend within its own timeout.
+type BackendWriter struct {
+	name        string
+	adapter     Adapter
+	workers     int
+	batchSize   int
+	queue       *Queue
+	stopShip    chan struct{}
+	readTimeout time.Duration
+	noRead      bool
+	writeConfig WriteConfig
+}
+
+func NewBackendWriter(config BackendConfig, writeConfig WriteConfig) (*BackendWriter, error) {
+	adapter, err := NewBackend(config, BackendOptions{
+		Name:      config.Name,
+		Workers:   config.Workers,
+		BatchSize: config.BatchSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := &BackendWriter{
+		name:        config.Name,
+		adapter:     NewResilientAdapter(config.Name, adapter, *config.Retry, *config.CircuitBreaker),
+		workers:     config.Workers,
+		batchSize:   config.BatchSize,
+		readTimeout: config.ReadTimeout,
+		noRead:      config.NoRead,
+		writeConfig: writeConfig,
+	}
+	if config.Queue != nil {
+		// queue is kept open when config is reloaded with the same queue dir
+		b.queue, err = acquireQueue(*config.Queue)
+		if err != nil {
+			return nil, err
+		}
+		b.stopShip = make(chan struct{})
+		queueMetrics.set(b)
+		go b.shipQueue()
+	}
+	writeWorkers.WithLabelValues(b.name).Set(float64(b.workers))
+	return b, nil
+}
+
+// Close stops shipping queue and flushes it to disk unless a writer of a reloaded config uses it,
+// data not yet sent stays in queue for next start
+func (b *BackendWriter) Close() error {
+	if b.queue == nil {
+		return nil
+	}
+	close(b.stopShip)
+	queueMetrics.remove(b)
+	return releaseQueue(b.queue)
+}
+
+func (b *BackendWriter) Name() string {
+	return b.name
+}
+
+func (b *BackendWriter) Adapter() Adapter {
+	return b.adapter
+}
+
+// read queries the backend, the query is cancelled when it takes longer than timeout or when ctx is done
+func (b *BackendWriter) read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.readTimeout)
+	defer cancel()
+	resp, err := b.adapter.Read(ctx, req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, NewRecoverableError(fmt.Errorf("read timed out after %s", b.readTimeout.String()))
+	}
+	return resp, err
+}
+
+// streamsSeries tells if series read from the backend can be sent one by one with readSeries
+func (b *BackendWriter) streamsSeries() bool {
+	a, ok := b.adapter.(*ResilientAdapter)
+	return ok && a.StreamsSeries()
+}
+
+// readSeries sends series of the query one by one, the query is cancelled when it takes longer than timeout
+// or when ctx is done
+func (b *BackendWriter) readSeries(ctx context.Context, q *prompb.Query, send func(*prompb.TimeSeries) error) error {
+	ctx, cancel := context.WithTimeout(ctx, b.readTimeout)
+	defer cancel()
+	err := b.adapter.(*ResilientAdapter).ReadSeries(ctx, q, send)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return NewRecoverableError(fmt.Errorf("read timed out after %s", b.readTimeout.String()))
+	}
+	return err
+}
+
+// write sends samples to the backend or, when a queue is set, appends the snappy encoded write request to the queue
+func (b *BackendWriter) write(entry *log.Entry, compressed []byte, samples model.Samples) *writeResult {
+	entry = entry.WithField("backend", b.name)
+	if b.queue == nil {
+		return b.writeSamples(entry, samples)
+	}
+	result := &writeResult{}
+	err := b.queue.Append(compressed)
+	if err != nil {
+		log.Error("Error when appending data to queue:" + err.Error())
+		result.addFailure(len(samples), NewRecoverableError(err))
+		return result
+	}
+	entry.Debug("Data appended to queue.")
+	return result
+}
+
+// shipQueue sends data stored in queue to the adapter until queue is closed or writer is closed,
+// data is kept in queue and sent again later when tsdb is failing
+func (b *BackendWriter) shipQueue() {
+	// wait for the writer of a previous config to stop reading the queue
+	select {
+	case b.queue.reader <- struct{}{}:
+	case <-b.stopShip:
+		return
+	}
+	defer func() { <-b.queue.reader }()
+	backoff := minShipBackoff
+	for {
+		select {
+		case <-b.stopShip:
+			return
+		default:
+		}
+		compressed, err := b.queue.Next(b.stopShip)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		entry := log.WithField("content_length", len(compressed)).
+			WithField("backend", b.name)
+		failed, err := b.writeCompressed(entry, compressed)
+		if err != nil && IsRecoverable(err) {
+			entry.Warnf("Error when shipping queued data to tsdb, retrying in %s: %s", backoff.String(), err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-b.stopShip:
+				return
+			}
+			backoff *= 2
+			if backoff > maxShipBackoff {
+				backoff = maxShipBackoff
+			}
+			continue
+		}
+		if err != nil {
+			entry.Error("Queued data rejected by tsdb, dropping it: " + err.Error())
+			samplesDropped.WithLabelValues("rejected_from_queue").Add(float64(failed))
+		} else {
+			entry.Debugf("Finished shipping queued data to tsdb in %s .", time.Since(start).String())
+		}
+		backoff = minShipBackoff
+		b.queue.Commit()
+	}
+}
+
+// writeCompressed sends a snappy encoded write request to the adapter and returns the number of failed samples
+func (b *BackendWriter) writeCompressed(entry *log.Entry, compressed []byte) (int, error) {
+	req, err := decodeWriteRequest(compressed)
+	if err != nil {
+		return 0, err
+	}
+	samples := protoToSamples(req, b.writeConfig)
+	result := b.writeSamples(entry, samples)
+	if result.failed == 0 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%d/%d samples failed: %s", result.failed, len(samples), result.err.Error())
+	if result.recoverable {
+		return result.failed, NewRecoverableError(err)
+	}
+	return result.failed, err
+}
+
+func (b *BackendWriter) writeSamples(entry *log.Entry, samples model.Samples) *writeResult {
+	// Get faster as possible by creating worker pool to send batches of samples through adapter
+	jobsSamples := make(chan model.Samples, b.workers)
+	result := &writeResult{}
+	var wg sync.WaitGroup
+	wg.Add(b.workers)
+	for w := 1; w <= b.workers; w++ {
+		go func(id int) {
+			defer wg.Done()
+			b.writeWorker(id, jobsSamples, result)
+		}(w)
+	}
+
+	for i := 0; i < len(samples); i += b.batchSize {
+		end := i + b.batchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+		entry.WithField("batch_size", end-i).Debug("Sending batch of samples")
+		writeBatchesPending.WithLabelValues(b.name).Inc()
+		jobsSamples <- samples[i:end]
+	}
+	close(jobsSamples)
+	wg.Wait()
+	return result
+}
+
+func (b *BackendWriter) writeWorker(id int, jobsSamples <-chan model.Samples, result *writeResult) {
+	entry := log.WithField("id", id).WithField("backend", b.name)
+	entry.Debug("Starting write worker...")
+	for samples := range jobsSamples {
+		writeBatchesPending.WithLabelValues(b.name).Dec()
+		writeWorkersBusy.WithLabelValues(b.name).Inc()
+		written, err := b.adapter.Write(samples)
+		writeWorkersBusy.WithLabelValues(b.name).Dec()
+		if err != nil {
+			entry.Debugf("Error when sending %d samples to tsdb: %s", len(samples), err.Error())
+			result.addFailure(len(samples), err)
+			samplesFailed.WithLabelValues(b.name, failureReason(err)).Add(float64(len(samples)))
+			continue
+		}
+		samplesWritten.WithLabelValues(b.name).Add(float64(written))
+	}
+	entry.Debug("Finished write worker.")
+}
+
+// writeResult collects errors returned by write workers for a single write request
+type writeResult struct {
+	mu          sync.Mutex
+	failed      int
+	recoverable bool
+	err         error
+}
+
+func (r *writeResult) addFailure(nbSamples int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed += nbSamples
+	// keep a recoverable error first as it is the one which decides of the response
+	if r.err == nil || (!r.recoverable && IsRecoverable(err)) {
+		r.err = err
+	}
+	r.recoverable = r.recoverable || IsRecoverable(err)
+}
+
+// statusCode gives back to prometheus a 5xx if it should retry the request
+// or a 4xx if data has been rejected and must be dropped
+func (r *writeResult) statusCode() int {
+	if r.recoverable {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func failureReason(err error) string {
+	if IsRecoverable(err) {
+		return "recoverable"
+	}
+	return "rejected"
+}
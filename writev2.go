@@ -0,0 +1,207 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	writev2 "github.com/prometheus/client_golang/exp/api/remote/genproto/v2"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"mime"
+)
+
+const (
+	writeV1Proto = "prometheus.WriteRequest"
+	writeV2Proto = "io.prometheus.write.v2.Request"
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// writeProto gives the message sent in a write request from its content type,
+// prometheus.WriteRequest is assumed when not set as with remote write 1.0 senders.
+func writeProto(contentType string) (string, error) {
+	if contentType == "" {
+		return writeV1Proto, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %s", mediaType)
+	}
+	switch params["proto"] {
+	case "", writeV1Proto:
+		return writeV1Proto, nil
+	case writeV2Proto:
+		return writeV2Proto, nil
+	}
+	return "", fmt.Errorf("unsupported proto message %s", params["proto"])
+}
+
+// decodeWriteV2Request decodes a remote write 2.0 request and converts it to a remote write 1.0 one,
+// labels are resolved from the symbols table and metadata of each series are sent as metric metadata.
+// Created timestamps are ignored as tsdbs have no place for them.
+func decodeWriteV2Request(buf []byte) (*prompb.WriteRequest, error) {
+	var v2 writev2.Request
+	if err := v2.UnmarshalVT(buf); err != nil {
+		return nil, err
+	}
+	req := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(v2.Timeseries)),
+	}
+	for _, series := range v2.Timeseries {
+		ts, metadata, err := convertWriteV2Series(series, v2.Symbols)
+		if err != nil {
+			return nil, err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+		if metadata != nil {
+			req.Metadata = append(req.Metadata, *metadata)
+		}
+	}
+	return req, nil
+}
+
+func convertWriteV2Series(series *writev2.TimeSeries, symbols []string) (prompb.TimeSeries, *prompb.MetricMetadata, error) {
+	var ts prompb.TimeSeries
+	var err error
+	ts.Labels, err = resolveLabelsRefs(series.LabelsRefs, symbols)
+	if err != nil {
+		return ts, nil, err
+	}
+	for _, s := range series.Samples {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: s.Value, Timestamp: s.Timestamp})
+	}
+	for _, h := range series.Histograms {
+		ts.Histograms = append(ts.Histograms, convertWriteV2Histogram(h))
+	}
+	for _, e := range series.Exemplars {
+		labels, err := resolveLabelsRefs(e.LabelsRefs, symbols)
+		if err != nil {
+			return ts, nil, err
+		}
+		ts.Exemplars = append(ts.Exemplars, prompb.Exemplar{Labels: labels, Value: e.Value, Timestamp: e.Timestamp})
+	}
+	metadata, err := convertWriteV2Metadata(series.Metadata, symbols)
+	if err != nil {
+		return ts, nil, err
+	}
+	if metadata != nil {
+		for _, l := range ts.Labels {
+			if l.Name == model.MetricNameLabel {
+				metadata.MetricFamilyName = l.Value
+			}
+		}
+	}
+	return ts, metadata, nil
+}
+
+// convertWriteV2Histogram keeps custom bucket bounds in unrecognized fields as prompb.Histogram doesn't know them
+func convertWriteV2Histogram(h *writev2.Histogram) prompb.Histogram {
+	histogram := prompb.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeSpans:  convertWriteV2Spans(h.NegativeSpans),
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveSpans:  convertWriteV2Spans(h.PositiveSpans),
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      prompb.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	switch count := h.Count.(type) {
+	case *writev2.Histogram_CountInt:
+		histogram.Count = &prompb.Histogram_CountInt{CountInt: count.CountInt}
+	case *writev2.Histogram_CountFloat:
+		histogram.Count = &prompb.Histogram_CountFloat{CountFloat: count.CountFloat}
+	}
+	switch count := h.ZeroCount.(type) {
+	case *writev2.Histogram_ZeroCountInt:
+		histogram.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: count.ZeroCountInt}
+	case *writev2.Histogram_ZeroCountFloat:
+		histogram.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: count.ZeroCountFloat}
+	}
+	if len(h.CustomValues) > 0 {
+		var packed []byte
+		for _, v := range h.CustomValues {
+			packed = protowire.AppendFixed64(packed, math.Float64bits(v))
+		}
+		histogram.XXX_unrecognized = protowire.AppendTag(nil, customValuesField, protowire.BytesType)
+		histogram.XXX_unrecognized = protowire.AppendBytes(histogram.XXX_unrecognized, packed)
+	}
+	return histogram
+}
+
+func convertWriteV2Spans(spans []*writev2.BucketSpan) []prompb.BucketSpan {
+	if spans == nil {
+		return nil
+	}
+	converted := make([]prompb.BucketSpan, len(spans))
+	for i, span := range spans {
+		converted[i] = prompb.BucketSpan{Offset: span.Offset, Length: span.Length}
+	}
+	return converted
+}
+
+// convertWriteV2Metadata returns nil when series has no metadata,
+// metric types have the same values in both versions
+func convertWriteV2Metadata(m *writev2.Metadata, symbols []string) (*prompb.MetricMetadata, error) {
+	if m == nil || (m.Type == writev2.Metadata_METRIC_TYPE_UNSPECIFIED && m.HelpRef == 0 && m.UnitRef == 0) {
+		return nil, nil
+	}
+	metadata := &prompb.MetricMetadata{Type: prompb.MetricMetadata_MetricType(m.Type)}
+	var err error
+	if metadata.Help, err = resolveSymbol(m.HelpRef, symbols); err != nil {
+		return nil, err
+	}
+	if metadata.Unit, err = resolveSymbol(m.UnitRef, symbols); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func resolveLabelsRefs(refs []uint32, symbols []string) ([]prompb.Label, error) {
+	if len(refs)%2 != 0 {
+		return nil, errors.New("labels refs must be pairs of name and value")
+	}
+	labels := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		name, err := resolveSymbol(refs[i], symbols)
+		if err != nil {
+			return nil, err
+		}
+		value, err := resolveSymbol(refs[i+1], symbols)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, prompb.Label{Name: name, Value: value})
+	}
+	return labels, nil
+}
+
+func resolveSymbol(ref uint32, symbols []string) (string, error) {
+	if int(ref) >= len(symbols) {
+		return "", fmt.Errorf("symbol ref %d out of symbols table of %d entries", ref, len(symbols))
+	}
+	return symbols[ref], nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Orange
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	writev2 "github.com/prometheus/client_golang/exp/api/remote/genproto/v2"
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"testing"
+)
+
+// writeV2Symbols is the symbols table of test requests, the empty string must be first
+var writeV2Symbols = []string{"", "__name__", "http_requests_total", "job", "api", "trace_id", "abc", "Requests count", "requests"}
+
+func decodeWriteV2TestSeries(t *testing.T, series ...*writev2.TimeSeries) (*prompb.WriteRequest, error) {
+	data, err := (&writev2.Request{Symbols: writeV2Symbols, Timeseries: series}).MarshalVT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeWriteV2Request(data)
+}
+
+func TestDecodeWriteV2Request(t *testing.T) {
+	labels := []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "job", Value: "api"}}
+	tests := []struct {
+		name     string
+		series   *writev2.TimeSeries
+		expected prompb.TimeSeries
+		metadata []prompb.MetricMetadata
+	}{
+		{
+			name: "samples",
+			series: &writev2.TimeSeries{
+				LabelsRefs:       []uint32{1, 2, 3, 4},
+				Samples:          []*writev2.Sample{{Value: 1.5, Timestamp: 1000}, {Value: 2.5, Timestamp: 2000}},
+				CreatedTimestamp: 500,
+			},
+			expected: prompb.TimeSeries{
+				Labels:  labels,
+				Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1000}, {Value: 2.5, Timestamp: 2000}},
+			},
+		},
+		{
+			name: "exemplars",
+			series: &writev2.TimeSeries{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []*writev2.Sample{{Value: 1, Timestamp: 1000}},
+				Exemplars:  []*writev2.Exemplar{{LabelsRefs: []uint32{5, 6}, Value: 2, Timestamp: 1500}},
+			},
+			expected: prompb.TimeSeries{
+				Labels:  labels,
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+				Exemplars: []prompb.Exemplar{{
+					Labels:    []prompb.Label{{Name: "trace_id", Value: "abc"}},
+					Value:     2,
+					Timestamp: 1500,
+				}},
+			},
+		},
+		{
+			name: "metadata",
+			series: &writev2.TimeSeries{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Metadata: &writev2.Metadata{
+					Type:    writev2.Metadata_METRIC_TYPE_COUNTER,
+					HelpRef: 7,
+					UnitRef: 8,
+				},
+			},
+			expected: prompb.TimeSeries{Labels: labels},
+			metadata: []prompb.MetricMetadata{{
+				Type:             prompb.MetricMetadata_COUNTER,
+				MetricFamilyName: "http_requests_total",
+				Help:             "Requests count",
+				Unit:             "requests",
+			}},
+		},
+		{
+			name: "empty metadata",
+			series: &writev2.TimeSeries{
+				LabelsRefs: []uint32{1, 2},
+				Metadata:   &writev2.Metadata{},
+			},
+			expected: prompb.TimeSeries{Labels: labels[:1]},
+		},
+		{
+			name: "histogram",
+			series: &writev2.TimeSeries{
+				LabelsRefs: []uint32{1, 2},
+				Histograms: []*writev2.Histogram{{
+					Count:          &writev2.Histogram_CountInt{CountInt: 3},
+					Sum:            4.5,
+					Schema:         -2,
+					ZeroThreshold:  0.001,
+					ZeroCount:      &writev2.Histogram_ZeroCountInt{ZeroCountInt: 1},
+					NegativeSpans:  []*writev2.BucketSpan{{Offset: 2, Length: 1}},
+					NegativeDeltas: []int64{1},
+					PositiveSpans:  []*writev2.BucketSpan{{Offset: -1, Length: 2}},
+					PositiveDeltas: []int64{1, -1},
+					ResetHint:      writev2.Histogram_RESET_HINT_NO,
+					Timestamp:      3000,
+				}},
+			},
+			expected: prompb.TimeSeries{
+				Labels: labels[:1],
+				Histograms: []prompb.Histogram{{
+					Count:          &prompb.Histogram_CountInt{CountInt: 3},
+					Sum:            4.5,
+					Schema:         -2,
+					ZeroThreshold:  0.001,
+					ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+					NegativeSpans:  []prompb.BucketSpan{{Offset: 2, Length: 1}},
+					NegativeDeltas: []int64{1},
+					PositiveSpans:  []prompb.BucketSpan{{Offset: -1, Length: 2}},
+					PositiveDeltas: []int64{1, -1},
+					ResetHint:      prompb.Histogram_NO,
+					Timestamp:      3000,
+				}},
+			},
+		},
+		{
+			name: "float histogram",
+			series: &writev2.TimeSeries{
+				LabelsRefs: []uint32{1, 2},
+				Histograms: []*writev2.Histogram{{
+					Count:          &writev2.Histogram_CountFloat{CountFloat: 2.5},
+					Sum:            10,
+					ZeroCount:      &writev2.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+					PositiveSpans:  []*writev2.BucketSpan{{Offset: 0, Length: 2}},
+					PositiveCounts: []float64{1, 1},
+					ResetHint:      writev2.Histogram_RESET_HINT_GAUGE,
+					Timestamp:      3000,
+				}},
+			},
+			expected: prompb.TimeSeries{
+				Labels: labels[:1],
+				Histograms: []prompb.Histogram{{
+					Count:          &prompb.Histogram_CountFloat{CountFloat: 2.5},
+					Sum:            10,
+					ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+					PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+					PositiveCounts: []float64{1, 1},
+					ResetHint:      prompb.Histogram_GAUGE,
+					Timestamp:      3000,
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := decodeWriteV2TestSeries(t, test.series)
+			if err != nil {
+				t.Fatalf("decoding request: %s", err)
+			}
+			if !reflect.DeepEqual(req.Timeseries, []prompb.TimeSeries{test.expected}) {
+				t.Errorf("series are\n%v\nexpected\n%v", req.Timeseries, test.expected)
+			}
+			if !reflect.DeepEqual(req.Metadata, test.metadata) {
+				t.Errorf("metadata are %v, expected %v", req.Metadata, test.metadata)
+			}
+		})
+	}
+}
+
+// prompb.Histogram has no custom values, they must still reach the conversion to classic buckets
+func TestDecodeWriteV2RequestCustomBuckets(t *testing.T) {
+	req, err := decodeWriteV2TestSeries(t, &writev2.TimeSeries{
+		LabelsRefs: []uint32{1, 2},
+		Histograms: []*writev2.Histogram{{
+			Count:          &writev2.Histogram_CountInt{CountInt: 3},
+			Schema:         customBucketsSchema,
+			PositiveSpans:  []*writev2.BucketSpan{{Offset: 0, Length: 3}},
+			PositiveDeltas: []int64{1, 0, 0},
+			CustomValues:   []float64{0.1, 0.5},
+			Timestamp:      3000,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("decoding request: %s", err)
+	}
+	values := histogramCustomValues(req.Timeseries[0].Histograms[0])
+	if !reflect.DeepEqual(values, []float64{0.1, 0.5}) {
+		t.Errorf("custom values are %v, expected [0.1 0.5]", values)
+	}
+}
+
+func TestDecodeWriteV2RequestErrors(t *testing.T) {
+	outOfTable := uint32(len(writeV2Symbols))
+	tests := []struct {
+		name   string
+		series *writev2.TimeSeries
+	}{
+		{"label ref out of symbols table", &writev2.TimeSeries{LabelsRefs: []uint32{1, outOfTable}}},
+		{"odd number of label refs", &writev2.TimeSeries{LabelsRefs: []uint32{1, 2, 3}}},
+		{"exemplar label ref out of symbols table", &writev2.TimeSeries{
+			LabelsRefs: []uint32{1, 2},
+			Exemplars:  []*writev2.Exemplar{{LabelsRefs: []uint32{outOfTable, 6}}},
+		}},
+		{"help ref out of symbols table", &writev2.TimeSeries{
+			LabelsRefs: []uint32{1, 2},
+			Metadata:   &writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_GAUGE, HelpRef: outOfTable},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeWriteV2TestSeries(t, test.series); err == nil {
+				t.Error("request must not be decoded")
+			}
+		})
+	}
+	if _, err := decodeWriteV2Request([]byte{0x2a, 0x05, 0x0a}); err == nil {
+		t.Error("truncated request must not be decoded")
+	}
+}